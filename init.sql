@@ -27,11 +27,41 @@ CREATE TABLE `car_model`(
 CREATE TABLE `ride_passenger`(
     `ride_id` BIGINT UNSIGNED NOT NULL,
     `passenger_id` BIGINT UNSIGNED NOT NULL,
+    -- booked for the passenger and the people they bring
+    `seats` INT UNSIGNED NOT NULL DEFAULT 1,
     `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP(),
+    -- bookings of rides with manual approval start as pending, pending and
+    -- accepted bookings hold their seats
+    `status` ENUM('pending', 'accepted', 'rejected', 'expired') NOT NULL DEFAULT 'accepted',
+    `reason` VARCHAR(255) NULL,
+    `decided_at` DATETIME NULL,
+    INDEX `ride_passenger_status`(`status`),
     PRIMARY KEY(`ride_id`, `passenger_id`)
 
 );
 
+-- riders waiting for seats on full rides, served in id order
+CREATE TABLE `ride_waitlist`(
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `ride_id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `seats` INT UNSIGNED NOT NULL DEFAULT 1,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP(),
+    UNIQUE(`ride_id`, `user_id`)
+);
+
+-- late cancellations and no-shows of passengers, they lower the reliability
+-- score of the user
+CREATE TABLE `passenger_incident`(
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `ride_id` BIGINT UNSIGNED NOT NULL,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `kind` ENUM('late_cancellation', 'no_show') NOT NULL,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP(),
+    UNIQUE(`ride_id`, `user_id`, `kind`),
+    INDEX `passenger_incident_user_id_kind`(`user_id`, `kind`)
+);
+
 CREATE TABLE `auth`(
     `token` VARCHAR(255) NOT NULL,
     `auth_service` VARCHAR(255) NOT NULL,
@@ -48,7 +78,33 @@ CREATE TABLE `ride`(
     `start_address` VARCHAR(255) NOT NULL,
     `end_city` VARCHAR(255) NOT NULL,
     `end_address` VARCHAR(255) NOT NULL,
-    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP()
+    -- at most the passenger count of the car category minus the driver
+    `seats_offered` INT UNSIGNED NOT NULL,
+    -- bookings wait for the driver to accept them
+    `manual_approval` BOOLEAN NOT NULL DEFAULT FALSE,
+    -- minutes before departure after which passengers cancelling are late
+    `cancellation_cutoff` INT UNSIGNED NOT NULL DEFAULT 0,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP(),
+    `status` ENUM('scheduled', 'boarding', 'in_progress', 'completed', 'cancelled') NOT NULL DEFAULT 'scheduled',
+    -- when the ride entered each status
+    `boarding_at` DATETIME NULL,
+    `started_at` DATETIME NULL,
+    `completed_at` DATETIME NULL,
+    `cancelled_at` DATETIME NULL,
+    -- ride search, addresses are matched with LIKE '%...%' and can't use an index
+    INDEX `ride_start_city_start_date`(`start_city`, `start_date`),
+    INDEX `ride_end_city_start_date`(`end_city`, `start_date`),
+    INDEX `ride_start_date`(`start_date`)
+);
+
+-- coordinates of the ride start and end, rides created before they were
+-- recorded have none and are only found by city
+CREATE TABLE `ride_location`(
+    `ride_id` BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+    `start_point` POINT NOT NULL SRID 4326,
+    `end_point` POINT NOT NULL SRID 4326,
+    SPATIAL INDEX `ride_location_start_point`(`start_point`),
+    SPATIAL INDEX `ride_location_end_point`(`end_point`)
 );
 
 CREATE TABLE `chat_message`(
@@ -63,10 +119,11 @@ CREATE TABLE `chat_message`(
 CREATE TABLE `user`(
     `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
     `name` VARCHAR(255) NOT NULL,
-    `email` VARCHAR(255) NOT NULL,
+    `email` VARCHAR(255) NOT NULL UNIQUE,
     `password` VARCHAR(255) NOT NULL,
     `role` VARCHAR(255) NOT NULL DEFAULT 'user',
     `settings` JSON NOT NULL,
+    `email_verified_at` DATETIME NULL,
     `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP()
 );
 
@@ -79,6 +136,77 @@ CREATE TABLE `user_feedback`(
     `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP()
 );
 
+CREATE TABLE `user_session`(
+    `id` VARCHAR(64) NOT NULL PRIMARY KEY,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `refresh_token_hash` CHAR(64) NOT NULL UNIQUE,
+    `expires_at` DATETIME NOT NULL,
+    `revoked_at` DATETIME NULL,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP()
+);
+
+-- Roles granted on top of the base role in user.role
+CREATE TABLE `user_role`(
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `role` VARCHAR(255) NOT NULL,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP(),
+    PRIMARY KEY(`user_id`, `role`)
+);
+
+CREATE TABLE `user_totp`(
+    `user_id` BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+    `secret` VARCHAR(64) NOT NULL,
+    `confirmed_at` DATETIME NULL,
+    `last_used_step` BIGINT NOT NULL DEFAULT 0,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP()
+);
+
+CREATE TABLE `user_recovery_code`(
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `code_hash` CHAR(64) NOT NULL,
+    `used_at` DATETIME NULL,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP(),
+    UNIQUE(`user_id`, `code_hash`)
+);
+
+-- Failed authentication attempts, only used by the "db" brute force store
+CREATE TABLE `auth_attempt`(
+    `attempt_key` VARCHAR(320) NOT NULL PRIMARY KEY,
+    `failures` INT UNSIGNED NOT NULL DEFAULT 0,
+    `last_failure` DATETIME NOT NULL,
+    `locked_until` DATETIME NULL
+);
+
+CREATE TABLE `security_event`(
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `type` VARCHAR(64) NOT NULL,
+    `subject` VARCHAR(320) NOT NULL,
+    `ip` VARCHAR(64) NOT NULL,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP()
+);
+
+-- Email verification and password reset tokens that were already used
+CREATE TABLE `used_token`(
+    `jti` VARCHAR(64) NOT NULL PRIMARY KEY,
+    `expires_at` DATETIME NOT NULL,
+    INDEX(`expires_at`)
+);
+
+-- Only a SHA-256 hash of the key is stored, the prefix identifies it in lists
+CREATE TABLE `api_key`(
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `user_id` BIGINT UNSIGNED NOT NULL,
+    `name` VARCHAR(255) NOT NULL,
+    `prefix` VARCHAR(16) NOT NULL,
+    `key_hash` CHAR(64) NOT NULL UNIQUE,
+    `scopes` VARCHAR(1024) NOT NULL,
+    `expires_at` DATETIME NULL,
+    `last_used_at` DATETIME NULL,
+    `revoked_at` DATETIME NULL,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP()
+);
+
 -- Foreign Key Constraints
 ALTER TABLE `ride` ADD CONSTRAINT `ride_owner_user_id_foreign` FOREIGN KEY(`owner_user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
 ALTER TABLE `user_feedback` ADD CONSTRAINT `user_feedback_ride_id_foreign` FOREIGN KEY(`ride_id`) REFERENCES `ride`(`id`) ON DELETE CASCADE;
@@ -87,33 +215,47 @@ ALTER TABLE `ride_passenger` ADD CONSTRAINT `ride_passenger_passenger_id_foreign
 ALTER TABLE `car_model` ADD CONSTRAINT `car_model_make_id_foreign` FOREIGN KEY(`make_id`) REFERENCES `car_make`(`id`) ON DELETE CASCADE;
 ALTER TABLE `auth` ADD CONSTRAINT `auth_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
 ALTER TABLE `ride_passenger` ADD CONSTRAINT `ride_passenger_ride_id_foreign` FOREIGN KEY(`ride_id`) REFERENCES `ride`(`id`) ON DELETE CASCADE;
+ALTER TABLE `ride_waitlist` ADD CONSTRAINT `ride_waitlist_ride_id_foreign` FOREIGN KEY(`ride_id`) REFERENCES `ride`(`id`) ON DELETE CASCADE;
+ALTER TABLE `ride_waitlist` ADD CONSTRAINT `ride_waitlist_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
+ALTER TABLE `passenger_incident` ADD CONSTRAINT `passenger_incident_ride_id_foreign` FOREIGN KEY(`ride_id`) REFERENCES `ride`(`id`) ON DELETE CASCADE;
+ALTER TABLE `passenger_incident` ADD CONSTRAINT `passenger_incident_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
+ALTER TABLE `ride_location` ADD CONSTRAINT `ride_location_ride_id_foreign` FOREIGN KEY(`ride_id`) REFERENCES `ride`(`id`) ON DELETE CASCADE;
 ALTER TABLE `car` ADD CONSTRAINT `car_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
 ALTER TABLE `car` ADD CONSTRAINT `car_model_id_foreign` FOREIGN KEY(`model_id`) REFERENCES `car_model`(`id`) ON DELETE CASCADE;
 ALTER TABLE `chat_message` ADD CONSTRAINT `chat_message_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
 ALTER TABLE `car_model` ADD CONSTRAINT `car_model_category_id_foreign` FOREIGN KEY(`category_id`) REFERENCES `car_category`(`id`) ON DELETE CASCADE;
 ALTER TABLE `user_feedback` ADD CONSTRAINT `user_feedback_owner_user_id_foreign` FOREIGN KEY(`owner_user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
+ALTER TABLE `user_session` ADD CONSTRAINT `user_session_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
+ALTER TABLE `user_role` ADD CONSTRAINT `user_role_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
+ALTER TABLE `user_totp` ADD CONSTRAINT `user_totp_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
+ALTER TABLE `user_recovery_code` ADD CONSTRAINT `user_recovery_code_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
+ALTER TABLE `api_key` ADD CONSTRAINT `api_key_user_id_foreign` FOREIGN KEY(`user_id`) REFERENCES `user`(`id`) ON DELETE CASCADE;
 
+-- Passwords are bcrypt hashes of password1 ... password20
 INSERT INTO `user` (`email`, `name`, `password`, `settings`) VALUES
-('tom@gmail.com', 'Tom Tommy', 'password1', '{}'),
-('jerry@gmail.com', 'Jerry Jefferson', 'password2', '{}'),
-('spike@gmail.com', 'Spike Spiky','password3', '{}'),
-('tyke@gmail.com', 'Tyke Tyson','password4', '{}'),
-('butch@gmail.com', 'Butch Butcherson', 'password5', '{}'),
-('lightning@gmail.com', 'Lightning McQueen', 'password6', '{}'),
-('tuffy@gmail.com', 'Tuffy Tufferson', 'password7', '{}'),
-('muscles@gmail.com', 'Muscles Muscly', 'password8', '{}'),
-('quacker@gmail.com', 'Tuffy Tufferson', 'password9', '{}'),
-('nibbles@gmail.com', 'Nibbles Nibbleson', 'password10', '{}'),
-('toodles@gmail.com', 'Toodles Toodleson', 'password11', '{}'),
-('mammy@gmail.com', 'Mammy Mommy', 'password12', '{}'),
-('george@gmail.com', 'George Washington', 'password13', '{}'),
-('joan@gmail.com', 'Joan Joahnson', 'password14', '{}'),
-('jeannie@gmail.com', 'Jeannie Marrie', 'password15', '{}'),
-('goldie@gmail.com', 'Goldie Gulderson', 'password16', '{}'),
-('fluff@gmail.com', 'Fluff Flufferson', 'password17', '{}'),
-('meathead@gmail.com', 'Meathead Metalicca', 'password18', '{}'),
-('cuckoo@gmail.com', 'Cuckoo Cucumber', 'password19', '{}'),
-('puddy@gmail.com', 'Puddy Pudgy', 'password20', '{}');
+('tom@gmail.com', 'Tom Tommy', '$2a$12$UUtPIKFdllrU3hj0DBi4luQkAfIb4zPI6M8odBhxcCReZjS7hTX/K', '{}'),
+('jerry@gmail.com', 'Jerry Jefferson', '$2a$12$cROQJgim6RFXU7cxR2HNz.m7ekhzWgCvvgrfKfMyDJ9AhlF2pFW9G', '{}'),
+('spike@gmail.com', 'Spike Spiky','$2a$12$ulz.Nb84geixju5PUTXYaOj7OuPFWZSCJxhlyIYQMUFuywinxrNUi', '{}'),
+('tyke@gmail.com', 'Tyke Tyson','$2a$12$Lqq0WAedXUmmJDU13ljbf.dI0meFZ83KTwX0MZdzhwDhnhhVJSo8m', '{}'),
+('butch@gmail.com', 'Butch Butcherson', '$2a$12$XYLrBlh6eYhYwd3Lao/p0uHuvGXLWx/8GR11Oitg5YF4dSQJtcDkO', '{}'),
+('lightning@gmail.com', 'Lightning McQueen', '$2a$12$wYYCpS8wFujb18/E.axTDO2QGqaQHczYq6jpVNaaWYgGnaINR1/yO', '{}'),
+('tuffy@gmail.com', 'Tuffy Tufferson', '$2a$12$USWFmXx.wombyLlxTk/ei.uF47yCyMV4AFOkAwOoTZ4TBTEbrmYYW', '{}'),
+('muscles@gmail.com', 'Muscles Muscly', '$2a$12$wGzMXSYX9TiqKpXChmJ8Ce.uK/cP5Gk0FUhRxq91k57Iqkx4YnAL2', '{}'),
+('quacker@gmail.com', 'Tuffy Tufferson', '$2a$12$PQeLbF4v8XhwD3AYF90OiOsW7zAMSWf3CWQshH2chzWU.BCUL2KxK', '{}'),
+('nibbles@gmail.com', 'Nibbles Nibbleson', '$2a$12$.t/ser8fdpm9hsE.Gaw/KeHuj5ODEP8bccDeoDKhisZvuyVAkZJI2', '{}'),
+('toodles@gmail.com', 'Toodles Toodleson', '$2a$12$5e8RhNxWmG4Ei/9YGiou8ubzb6gS8DGGZKvT0Bq9gTK30bCo7WEWC', '{}'),
+('mammy@gmail.com', 'Mammy Mommy', '$2a$12$17VIQtj51myS6EJlC4ip.euJNnHoiK7jblS2S4uXhrLV49DtpA7rO', '{}'),
+('george@gmail.com', 'George Washington', '$2a$12$I7.wyDXFPbr.5yaeqdjDw.hG8kdpOdzEAK7qIwgXt00ggH0rWWKDC', '{}'),
+('joan@gmail.com', 'Joan Joahnson', '$2a$12$tTkcU7gPlnyKC/llr5G5JeMk5twYlrBgZkbckThuDimZMIf6IOXoi', '{}'),
+('jeannie@gmail.com', 'Jeannie Marrie', '$2a$12$UEqDv0znl7wnfGAvB2S4Mume2XyvvoAClOI5GbdREVwK5a7p1ztLe', '{}'),
+('goldie@gmail.com', 'Goldie Gulderson', '$2a$12$xDBkm7DH5kglzeJtmzWgvOSQfV4yy1X0S0ymd7enMglufW1kaQkM.', '{}'),
+('fluff@gmail.com', 'Fluff Flufferson', '$2a$12$2b3dUTK2LXzi7SmmfLRmvuzx5US1DHW3jMof2fFot/6Uy/2akW9vS', '{}'),
+('meathead@gmail.com', 'Meathead Metalicca', '$2a$12$L6vzf7wNItwLG7lX5lWTP.sDCgrQoCjl1eMzc5ELbtBB71pCioG0.', '{}'),
+('cuckoo@gmail.com', 'Cuckoo Cucumber', '$2a$12$qkviLUl6bX3v7YspH3NuBeYe5aYAiZ2W6HfTlobPf/z8F.9Phiau.', '{}'),
+('puddy@gmail.com', 'Puddy Pudgy', '$2a$12$lgHDU43i1A1bSrWuPl0AUOxMJD6RHYD6cAgTChy6eg7xzFw0voZgq', '{}');
+
+-- Seeded accounts start out verified
+UPDATE `user` SET `email_verified_at` = `created_at`;
 
 INSERT INTO `car_make` (`name`) VALUES
 ('Toyota'),
@@ -367,18 +509,33 @@ INSERT INTO `car` (`user_id`, `year`, `model_id`) VALUES
 (3, 2018, 3),
 (3, 2021, 4);
 
+-- Car owners are drivers
+INSERT INTO `user_role` (`user_id`, `role`) VALUES
+(1, 'driver'),
+(2, 'driver'),
+(3, 'driver');
+
 -- Insert rides
-INSERT INTO `ride` (`owner_user_id`, `vehicle_id`, `start_date`, `start_city`, `start_address`, `end_city`, `end_address`) VALUES
-(1, 1, '2023-10-01 08:00:00', 'New York', '123 Main St', 'Boston', '456 Elm St'),
-(1, 1, '2023-10-02 09:00:00', 'Los Angeles', '789 Oak St', 'San Francisco', '101 Pine St'),
-(2, 2, '2023-10-03 10:00:00', 'Chicago', '202 Maple St', 'Detroit', '303 Birch St'),
-(2, 3, '2023-10-04 11:00:00', 'Houston', '404 Cedar St', 'Dallas', '505 Walnut St'),
-(3, 4, '2023-10-05 12:00:00', 'Phoenix', '606 Spruce St', 'Tucson', '707 Fir St'),
-(3, 4, '2023-10-06 13:00:00', 'Philadelphia', '808 Ash St', 'Pittsburgh', '909 Poplar St'),
-(3, 4, '2023-10-07 14:00:00', 'San Antonio', '1010 Willow St', 'Austin', '1111 Cypress St'),
-(3, 4, '2023-10-08 15:00:00', 'San Diego', '1212 Redwood St', 'Las Vegas', '1313 Palm St'),
-(3, 4, '2023-10-09 16:00:00', 'Dallas', '1414 Magnolia St', 'Houston', '1515 Dogwood St'),
-(3, 4, '2023-10-10 17:00:00', 'San Jose', '1616 Cherry St', 'Sacramento', '1717 Peach St');
+INSERT INTO `ride` (`owner_user_id`, `vehicle_id`, `start_date`, `start_city`, `start_address`, `end_city`, `end_address`, `seats_offered`) VALUES
+(1, 1, '2023-10-01 08:00:00', 'New York', '123 Main St', 'Boston', '456 Elm St', 4),
+(1, 1, '2023-10-02 09:00:00', 'Los Angeles', '789 Oak St', 'San Francisco', '101 Pine St', 4),
+(2, 2, '2023-10-03 10:00:00', 'Chicago', '202 Maple St', 'Detroit', '303 Birch St', 4),
+(2, 3, '2023-10-04 11:00:00', 'Houston', '404 Cedar St', 'Dallas', '505 Walnut St', 4),
+(3, 4, '2023-10-05 12:00:00', 'Phoenix', '606 Spruce St', 'Tucson', '707 Fir St', 4),
+(3, 4, '2023-10-06 13:00:00', 'Philadelphia', '808 Ash St', 'Pittsburgh', '909 Poplar St', 4),
+(3, 4, '2023-10-07 14:00:00', 'San Antonio', '1010 Willow St', 'Austin', '1111 Cypress St', 4),
+(3, 4, '2023-10-08 15:00:00', 'San Diego', '1212 Redwood St', 'Las Vegas', '1313 Palm St', 4),
+(3, 4, '2023-10-09 16:00:00', 'Dallas', '1414 Magnolia St', 'Houston', '1515 Dogwood St', 4),
+(3, 4, '2023-10-10 17:00:00', 'San Jose', '1616 Cherry St', 'Sacramento', '1717 Peach St', 4);
+
+-- the seeded rides are in the past
+UPDATE `ride` SET `status` = 'completed', `started_at` = `start_date`, `completed_at` = `start_date` + INTERVAL 3 HOUR;
+
+-- Insert ride locations
+INSERT INTO `ride_location` (`ride_id`, `start_point`, `end_point`) VALUES
+(1, ST_GeomFromText('POINT(40.7128 -74.006)', 4326, 'axis-order=lat-long'), ST_GeomFromText('POINT(42.3601 -71.0589)', 4326, 'axis-order=lat-long')),
+(2, ST_GeomFromText('POINT(34.0522 -118.2437)', 4326, 'axis-order=lat-long'), ST_GeomFromText('POINT(37.7749 -122.4194)', 4326, 'axis-order=lat-long')),
+(3, ST_GeomFromText('POINT(41.8781 -87.6298)', 4326, 'axis-order=lat-long'), ST_GeomFromText('POINT(42.3314 -83.0458)', 4326, 'axis-order=lat-long'));
 
 -- Insert ride passengers
 INSERT INTO `ride_passenger` (`ride_id`, `passenger_id`) VALUES
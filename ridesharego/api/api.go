@@ -5,8 +5,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"main/auth"
 	"main/core"
+	"main/geo"
+	"main/mail"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -14,13 +19,23 @@ import (
 
 const responseTypeXML = "application/xml"
 
-func CreateRouter(db *sql.DB, authSecret string) *mux.Router {
+// IdentityHandlers serve the login identities linked to a user, which need
+// the OAuth2 providers of the auth package.
+type IdentityHandlers interface {
+	GetIdentities(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)
+	LinkIdentity(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)
+	UnlinkIdentity(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)
+}
+
+func CreateRouter(db *sql.DB, keys *auth.Keyring, limiter *auth.Limiter, gazetteer *geo.Gazetteer, mailer mail.Mailer, identities IdentityHandlers) *mux.Router {
 	r := mux.NewRouter()
 	r.Use(loggerMiddleware)
 
 	dbMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := context.WithValue(r.Context(), core.CtxDB, db)
+			ctx = context.WithValue(ctx, core.CtxGazetteer, gazetteer)
+			ctx = context.WithValue(ctx, core.CtxMailer, mailer)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
@@ -29,12 +44,12 @@ func CreateRouter(db *sql.DB, authSecret string) *mux.Router {
 	// Google OAuth2 endpoint
 	api := r.PathPrefix("/api/v1").Subrouter()
 
-	withAdmin := func(handler func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)) http.HandlerFunc {
-		return authMiddleware(authSecret, core.RoleAdmin, withMiddleware(handler))
+	withPermission := func(permission string, handler func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)) http.HandlerFunc {
+		return authMiddleware(keys, limiter, permission, withMiddleware(handler))
 	}
 
 	withUser := func(handler func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)) http.HandlerFunc {
-		return authMiddleware(authSecret, core.RoleUser, withMiddleware(handler))
+		return withPermission("", handler)
 	}
 
 	withGuest := func(handler func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)) http.HandlerFunc {
@@ -44,20 +59,41 @@ func CreateRouter(db *sql.DB, authSecret string) *mux.Router {
 	// Ride endpoints
 	api.HandleFunc("/rides", withGuest(getRides)).Methods("GET")
 	api.HandleFunc("/ride/{ride_id}", withGuest(getRide)).Methods("GET")
-	api.HandleFunc("/ride", withUser(createRide)).Methods("POST")
+	api.HandleFunc("/ride", withPermission(core.PermRideCreate, createRide)).Methods("POST")
 	api.HandleFunc("/ride/{ride_id}", withUser(updateRide)).Methods("PUT")
 	api.HandleFunc("/ride/{ride_id}", withUser(deleteRide)).Methods("DELETE")
+	api.HandleFunc("/ride/{ride_id}/board", withUser(transitionRide(core.RideBoarding))).Methods("POST")
+	api.HandleFunc("/ride/{ride_id}/start", withUser(transitionRide(core.RideInProgress))).Methods("POST")
+	api.HandleFunc("/ride/{ride_id}/complete", withUser(transitionRide(core.RideCompleted))).Methods("POST")
+	api.HandleFunc("/ride/{ride_id}/cancel", withUser(transitionRide(core.RideCancelled))).Methods("POST")
 	api.HandleFunc("/user/{user_id}/rides", withUser(getUserRides)).Methods("GET")
 
+	// Place endpoints
+	api.HandleFunc("/places", withGuest(getPlaces)).Methods("GET")
+
 	// User endpoints
-	api.HandleFunc("/users", withAdmin(getUsers)).Methods("GET")
+	api.HandleFunc("/users", withPermission(core.PermUserReadAny, getUsers)).Methods("GET")
 	api.HandleFunc("/user/{user_id}", withUser(getUser)).Methods("GET")
-	api.HandleFunc("/user", withAdmin(createUser)).Methods("POST")
-	api.HandleFunc("/user/{user_id}", withUser(updateUser)).Methods("PUT")
-	api.HandleFunc("/user/{user_id}", withUser(deleteUser)).Methods("DELETE")
+	api.HandleFunc("/user", withPermission(core.PermUserCreate, createUser)).Methods("POST")
+	api.HandleFunc("/user/{user_id}", withUser(withoutAPIKey(updateUser))).Methods("PUT")
+	api.HandleFunc("/user/{user_id}", withUser(withoutAPIKey(deleteUser))).Methods("DELETE")
+	api.HandleFunc("/user/{user_id}/identities", withUser(withoutAPIKey(identities.GetIdentities))).Methods("GET")
+	api.HandleFunc("/user/{user_id}/identities/{provider}", withUser(withoutAPIKey(identities.LinkIdentity))).Methods("POST")
+	api.HandleFunc("/user/{user_id}/identities/{provider}", withUser(withoutAPIKey(identities.UnlinkIdentity))).Methods("DELETE")
+
+	// Role endpoints
+	api.HandleFunc("/roles", withUser(getRoles)).Methods("GET")
+	api.HandleFunc("/user/{user_id}/roles", withUser(getUserRoles)).Methods("GET")
+	api.HandleFunc("/user/{user_id}/role/{role}", withPermission(core.PermRoleGrant, grantUserRole)).Methods("PUT")
+	api.HandleFunc("/user/{user_id}/role/{role}", withPermission(core.PermRoleGrant, revokeUserRole)).Methods("DELETE")
+
+	// API key endpoints
+	api.HandleFunc("/user/{user_id}/api_keys", withUser(getUserAPIKeys)).Methods("GET")
+	api.HandleFunc("/user/{user_id}/api_key", withUser(createAPIKey)).Methods("POST")
+	api.HandleFunc("/user/{user_id}/api_key/{key_id}", withUser(revokeAPIKey)).Methods("DELETE")
 
 	// Car endpoints
-	api.HandleFunc("/cars", withAdmin(getCars)).Methods("GET")
+	api.HandleFunc("/cars", withPermission(core.PermCarReadAny, getCars)).Methods("GET")
 	api.HandleFunc("/car/{car_id}", withUser(getCar)).Methods("GET")
 	api.HandleFunc("/car", withUser(createCar)).Methods("POST")
 	api.HandleFunc("/car/{car_id}", withUser(updateCar)).Methods("PUT")
@@ -67,32 +103,40 @@ func CreateRouter(db *sql.DB, authSecret string) *mux.Router {
 	// Car model endpoints
 	api.HandleFunc("/car_models", withGuest(getCarModels)).Methods("GET")
 	api.HandleFunc("/car_model/{model_id}", withGuest(getCarModel)).Methods("GET")
-	api.HandleFunc("/car_model", withAdmin(createCarModel)).Methods("POST")
-	api.HandleFunc("/car_model/{model_id}", withAdmin(updateCarModel)).Methods("PUT")
-	api.HandleFunc("/car_model/{model_id}", withAdmin(deleteCarModel)).Methods("DELETE")
+	api.HandleFunc("/car_model", withPermission(core.PermCatalogWrite, createCarModel)).Methods("POST")
+	api.HandleFunc("/car_model/{model_id}", withPermission(core.PermCatalogWrite, updateCarModel)).Methods("PUT")
+	api.HandleFunc("/car_model/{model_id}", withPermission(core.PermCatalogWrite, deleteCarModel)).Methods("DELETE")
 
 	// Car make endpoints
 	api.HandleFunc("/car_makes", withGuest(getCarMakes)).Methods("GET")
 	api.HandleFunc("/car_make/{make_id}", withGuest(getCarMake)).Methods("GET")
-	api.HandleFunc("/car_make", withAdmin(createCarMake)).Methods("POST")
-	api.HandleFunc("/car_make/{make_id}", withAdmin(updateCarMake)).Methods("PUT")
-	api.HandleFunc("/car_make/{make_id}", withAdmin(deleteCarMake)).Methods("DELETE")
+	api.HandleFunc("/car_make", withPermission(core.PermCatalogWrite, createCarMake)).Methods("POST")
+	api.HandleFunc("/car_make/{make_id}", withPermission(core.PermCatalogWrite, updateCarMake)).Methods("PUT")
+	api.HandleFunc("/car_make/{make_id}", withPermission(core.PermCatalogWrite, deleteCarMake)).Methods("DELETE")
 
 	// Car category endpoints
 	api.HandleFunc("/car_categories", withGuest(getCarCategories)).Methods("GET")
 	api.HandleFunc("/car_category/{category_id}", withGuest(getCarCategory)).Methods("GET")
-	api.HandleFunc("/car_category", withAdmin(createCarCategory)).Methods("POST")
-	api.HandleFunc("/car_category/{category_id}", withAdmin(updateCarCategory)).Methods("PUT")
-	api.HandleFunc("/car_category/{category_id}", withAdmin(deleteCarCategory)).Methods("DELETE")
+	api.HandleFunc("/car_category", withPermission(core.PermCatalogWrite, createCarCategory)).Methods("POST")
+	api.HandleFunc("/car_category/{category_id}", withPermission(core.PermCatalogWrite, updateCarCategory)).Methods("PUT")
+	api.HandleFunc("/car_category/{category_id}", withPermission(core.PermCatalogWrite, deleteCarCategory)).Methods("DELETE")
 
 	// Ride passenger endpoints
 	api.HandleFunc("/ride/{ride_id}/passengers", withUser(getRidePassengers)).Methods("GET")
 	api.HandleFunc("/ride/{ride_id}/passenger/{user_id}", withUser(createRidePassenger)).Methods("POST")
 	api.HandleFunc("/ride/{ride_id}/passenger/{user_id}", withUser(deleteRidePassenger)).Methods("DELETE")
+	api.HandleFunc("/ride/{ride_id}/passenger/{user_id}/accept", withUser(decideBooking(core.PassengerAccepted))).Methods("POST")
+	api.HandleFunc("/ride/{ride_id}/passenger/{user_id}/reject", withUser(decideBooking(core.PassengerRejected))).Methods("POST")
+	api.HandleFunc("/ride/{ride_id}/passenger/{user_id}/no_show", withUser(reportNoShow)).Methods("POST")
+
+	// Waitlist endpoints
+	api.HandleFunc("/ride/{ride_id}/waitlist", withUser(joinWaitlist)).Methods("POST")
+	api.HandleFunc("/ride/{ride_id}/waitlist", withUser(getWaitlistPosition)).Methods("GET")
+	api.HandleFunc("/ride/{ride_id}/waitlist", withUser(leaveWaitlist)).Methods("DELETE")
 
 	// Feedback endpoints
-	api.HandleFunc("/feedback", withAdmin(getFeedbacks)).Methods("GET")
-	api.HandleFunc("/feedback/{feedback_id}", withAdmin(getFeedback)).Methods("GET")
+	api.HandleFunc("/feedback", withPermission(core.PermFeedbackReadAny, getFeedbacks)).Methods("GET")
+	api.HandleFunc("/feedback/{feedback_id}", withPermission(core.PermFeedbackReadAny, getFeedback)).Methods("GET")
 	api.HandleFunc("/feedback", withUser(createFeedback)).Methods("POST")
 	api.HandleFunc("/feedback/{feedback_id}", withUser(updateFeedback)).Methods("PUT")
 	api.HandleFunc("/feedback/{feedback_id}", withUser(deleteFeedback)).Methods("DELETE")
@@ -103,6 +147,26 @@ func CreateRouter(db *sql.DB, authSecret string) *mux.Router {
 	return r
 }
 
+// parsePageRequest reads the limit, cursor and sort parameters of the list
+// endpoints. The sort fields are checked by the list itself.
+func parsePageRequest(r *http.Request) (core.PageRequest, error) {
+	query := r.URL.Query()
+	page := core.PageRequest{
+		Cursor: query.Get("cursor"),
+		Sort:   query.Get("sort"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		limitInt, err := strconv.Atoi(limit)
+		if err != nil || limitInt <= 0 {
+			return page, errors.New("invalid limit")
+		}
+		page.Limit = limitInt
+	}
+
+	return page, nil
+}
+
 func respond(w http.ResponseWriter, r *http.Request, data any) {
 	acceptHeader := r.Header.Get("Accept")
 
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"main/auth"
+	"main/core"
+	"main/db"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// authorizeAPIKeys returns the user whose API keys are managed. Keys can
+// only be managed with a session, a leaked key must not be able to create
+// more keys or keep itself alive.
+func authorizeAPIKeys(w http.ResponseWriter, r *http.Request, log *logrus.Entry, permission string) (int, bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		log.WithError(err).Error("parsing user_id")
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	if userAuth.APIKeyID != 0 {
+		http.Error(w, "API keys can't manage API keys", http.StatusForbidden)
+		return 0, false
+	}
+
+	if userID != userAuth.UserID && !userAuth.Can(permission) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return 0, false
+	}
+
+	return userID, true
+}
+
+func getUserAPIKeys(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, ok := authorizeAPIKeys(w, r, log, core.PermAPIKeyReadAny)
+	if !ok {
+		return
+	}
+
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := db.GetAPIKeysByUserID(d, userID, page)
+	if err != nil {
+		log.WithError(err).Error("getting API keys")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	respond(w, r, keys)
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, ok := authorizeAPIKeys(w, r, log, core.PermAPIKeyWriteAny)
+	if !ok {
+		return
+	}
+
+	var request core.APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := request.Validate(now); err != nil {
+		http.Error(w, fmt.Sprintf("validating request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	roles, err := db.GetUserRoles(d, userID)
+	if err != nil {
+		log.WithError(err).Error("getting user roles")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	// a key can't be given permissions its user doesn't hold, it would lose
+	// them on every request anyway
+	owner := core.NewUserAuth(userID, "", roles)
+	for _, scope := range request.Scopes {
+		if scope != core.ScopeRead && scope != core.ScopeWrite && !owner.Can(scope) {
+			http.Error(w, fmt.Sprintf("validating request: user doesn't hold %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		log.WithError(err).Error("generating API key")
+		http.Error(w, "generating API key", http.StatusInternalServerError)
+		return
+	}
+
+	apiKey := core.APIKey{
+		UserID:    userID,
+		Name:      request.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    request.Scopes,
+		ExpiresAt: request.ExpiresAt,
+		CreatedAt: now.Format(time.DateTime),
+	}
+
+	id, err := db.CreateAPIKey(d, apiKey)
+	if err != nil {
+		log.WithError(err).Error("creating API key")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+	apiKey.ID = int(id)
+
+	w.WriteHeader(http.StatusCreated)
+	respond(w, r, core.CreatedAPIKey{APIKey: apiKey, Key: key})
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, ok := authorizeAPIKeys(w, r, log, core.PermAPIKeyWriteAny)
+	if !ok {
+		return
+	}
+
+	keyID, err := strconv.Atoi(mux.Vars(r)["key_id"])
+	if err != nil {
+		log.WithError(err).Error("parsing key_id")
+		http.Error(w, "invalid key_id", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.RevokeAPIKey(d, userID, keyID); err != nil {
+		log.WithError(err).Error("revoking API key")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"main/core"
+	"main/db"
+	"main/mail"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultApprovalDeadline = time.Hour
+	defaultExpiryInterval   = time.Minute
+	maxReasonLength         = 255
+)
+
+// decideBooking returns the handler with which the driver accepts or rejects
+// a pending booking. Rejections need a reason.
+func decideBooking(status string) func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB) {
+	return func(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+		vars := mux.Vars(r)
+
+		rideIDInt, err := strconv.Atoi(vars["ride_id"])
+		if err != nil {
+			log.WithError(err).Error("parsing ride_id")
+			http.Error(w, "invalid ride_id", http.StatusBadRequest)
+			return
+		}
+
+		userIDInt, err := strconv.Atoi(vars["user_id"])
+		if err != nil {
+			log.WithError(err).Error("parsing user_id")
+			http.Error(w, "invalid user_id", http.StatusBadRequest)
+			return
+		}
+
+		var decision core.BookingDecision
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil && err != io.EOF {
+			log.WithError(err).Error("decoding request")
+			http.Error(w, "decoding request", http.StatusBadRequest)
+			return
+		}
+
+		var reason *string
+		if decision.Reason = strings.TrimSpace(decision.Reason); decision.Reason != "" {
+			reason = &decision.Reason
+		}
+
+		if status == core.PassengerRejected && reason == nil {
+			http.Error(w, "missing reason", http.StatusBadRequest)
+			return
+		}
+
+		if len(decision.Reason) > maxReasonLength {
+			http.Error(w, "reason is too long", http.StatusBadRequest)
+			return
+		}
+
+		ride, err := db.GetRideByID(d, rideIDInt)
+		if err != nil {
+			log.WithError(err).Error("getting ride")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, fmt.Sprintf("getting ride: %s", error), status)
+			return
+		}
+
+		userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+		if ride.OwnerID != userAuth.UserID && !userAuth.Can(core.PermPassengerWriteAny) {
+			http.Error(w, "unauthorized", http.StatusForbidden)
+			return
+		}
+
+		// the checks run with the ride locked, so it can't start or be
+		// cancelled before the decision is stored
+		var conflict error
+		promoted, err := db.DecideBooking(d, rideIDInt, userIDInt, status, reason, func(ride *core.Ride, booking *core.Passenger) error {
+			switch {
+			case ride.Status != core.RideScheduled && ride.Status != core.RideBoarding:
+				conflict = fmt.Errorf("ride is %s", ride.Status)
+			case booking.Status != core.PassengerPending:
+				conflict = fmt.Errorf("booking is %s", booking.Status)
+			}
+			return conflict
+		})
+		if conflict != nil {
+			http.Error(w, conflict.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("deciding booking")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, error, status)
+			return
+		}
+		notifyPromoted(r, log, d, ride, promoted)
+
+		booking, err := db.GetPassengerByRideIDAndUserID(d, rideIDInt, userIDInt)
+		if err != nil {
+			log.WithError(err).Error("getting ride passenger")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, fmt.Sprintf("getting ride passenger: %s", error), status)
+			return
+		}
+
+		respond(w, r, booking)
+	}
+}
+
+// ExpireBookings expires pending booking requests once their ride starts
+// within the approval deadline, checking every interval. Riders who get the
+// freed seats from the waitlist are mailed.
+func ExpireBookings(d *sql.DB, config core.BookingConfig, mailer mail.Mailer, log *logrus.Entry) {
+	deadline := config.ApprovalDeadline.Duration
+	if deadline == 0 {
+		deadline = defaultApprovalDeadline
+	}
+
+	interval := config.ExpiryInterval.Duration
+	if interval == 0 {
+		interval = defaultExpiryInterval
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			expired, promotions, err := db.ExpirePendingBookings(d, deadline)
+			if err != nil {
+				log.WithError(err).Error("expiring pending bookings")
+			}
+
+			if expired > 0 {
+				log.WithField("bookings", expired).Info("expired pending bookings")
+			}
+
+			// the rides that expired before an error still promoted their waitlist
+			for _, promotion := range promotions {
+				mailPromoted(mailer, log, d, &promotion.Ride, promotion.Promoted)
+			}
+		}
+	}()
+}
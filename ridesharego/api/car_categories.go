@@ -14,7 +14,13 @@ import (
 )
 
 func getCarCategories(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
-	categories, err := db.GetCarCategories(d)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	categories, err := db.GetCarCategories(d, page)
 	if err != nil {
 		log.WithError(err).Error("getting car categories")
 		error, status := db.SqlErrorToHTTP(err)
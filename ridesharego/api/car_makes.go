@@ -14,7 +14,13 @@ import (
 )
 
 func getCarMakes(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
-	makes, err := db.GetCarMakes(d)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	makes, err := db.GetCarMakes(d, page)
 	if err != nil {
 		log.WithError(err).Error("getting car makes")
 		error, status := db.SqlErrorToHTTP(err)
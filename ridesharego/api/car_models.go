@@ -14,7 +14,13 @@ import (
 )
 
 func getCarModels(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
-	models, err := db.GetCarModels(d)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	models, err := db.GetCarModels(d, page)
 	if err != nil {
 		log.WithError(err).Error("getting car models")
 		error, status := db.SqlErrorToHTTP(err)
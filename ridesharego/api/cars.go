@@ -14,7 +14,13 @@ import (
 )
 
 func getCars(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
-	cars, err := db.GetCars(d)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cars, err := db.GetCars(d, page)
 	if err != nil {
 		log.WithError(err).Error("getting cars")
 		error, status := db.SqlErrorToHTTP(err)
@@ -50,7 +56,7 @@ func getCar(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if car.UserID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if car.UserID != userAuth.UserID && !userAuth.Can(core.PermCarReadAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -67,7 +73,7 @@ func createCar(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if car.UserID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if car.UserID != userAuth.UserID && !userAuth.Can(core.PermCarWriteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -111,6 +117,14 @@ func createCar(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql
 	}
 	car.ID = int(id)
 
+	// owning a car is what allows a user to offer rides
+	if err := db.GrantUserRole(d, car.UserID, core.RoleDriver); err != nil {
+		log.WithError(err).Error("granting driver role")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	respond(w, r, car)
 }
@@ -138,8 +152,16 @@ func updateCar(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql
 		return
 	}
 
+	existingCar, err := db.GetCarByID(d, idInt)
+	if err != nil {
+		log.WithError(err).Error("getting car")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, fmt.Sprintf("getting car: %s", error), status)
+		return
+	}
+
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if car.UserID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if (existingCar.UserID != userAuth.UserID || car.UserID != userAuth.UserID) && !userAuth.Can(core.PermCarWriteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -174,13 +196,6 @@ func updateCar(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql
 		return
 	}
 
-	if _, err := db.GetCarByID(d, idInt); err != nil {
-		log.WithError(err).Error("getting car")
-		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, fmt.Sprintf("getting car: %s", error), status)
-		return
-	}
-
 	if err := db.UpdateCar(d, idInt, car); err != nil {
 		log.WithError(err).Error("updating car")
 		error, status := db.SqlErrorToHTTP(err)
@@ -207,19 +222,20 @@ func deleteCar(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql
 		return
 	}
 
-	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if idInt != userAuth.UserID && userAuth.Role != core.RoleAdmin {
-		http.Error(w, "unauthorized", http.StatusForbidden)
-		return
-	}
-
-	if _, err := db.GetCarByID(d, idInt); err != nil {
+	car, err := db.GetCarByID(d, idInt)
+	if err != nil {
 		log.WithError(err).Error("getting car")
 		error, status := db.SqlErrorToHTTP(err)
 		http.Error(w, fmt.Sprintf("getting car: %s", error), status)
 		return
 	}
 
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	if car.UserID != userAuth.UserID && !userAuth.Can(core.PermCarWriteAny) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+
 	if err := db.DeleteCar(d, idInt); err != nil {
 		log.WithError(err).Error("deleting car")
 		error, status := db.SqlErrorToHTTP(err)
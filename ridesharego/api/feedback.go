@@ -14,7 +14,13 @@ import (
 )
 
 func getFeedbacks(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
-	feedbacks, err := db.GetFeedbacks(d)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feedbacks, err := db.GetFeedbacks(d, page)
 	if err != nil {
 		log.WithError(err).Error("getting feedbacks")
 		error, status := db.SqlErrorToHTTP(err)
@@ -68,7 +74,13 @@ func getRideFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Entry,
 		return
 	}
 
-	feedbacks, err := db.GetFeedbacksByRideID(d, rideIDInt)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feedbacks, err := db.GetFeedbacksByRideID(d, rideIDInt, page)
 	if err != nil {
 		log.WithError(err).Error("getting ride feedbacks")
 		error, status := db.SqlErrorToHTTP(err)
@@ -96,12 +108,18 @@ func getUserFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Entry,
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if userIDInt != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if userIDInt != userAuth.UserID && !userAuth.Can(core.PermFeedbackReadAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	feedbacks, err := db.GetFeedbacksByUserID(d, userIDInt)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feedbacks, err := db.GetFeedbacksByUserID(d, userIDInt, page)
 	if err != nil {
 		log.WithError(err).Error("getting user feedbacks")
 		error, status := db.SqlErrorToHTTP(err)
@@ -142,12 +160,18 @@ func getUserRideFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Ent
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if userIDInt != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if userIDInt != userAuth.UserID && !userAuth.Can(core.PermFeedbackReadAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	feedbacks, err := db.GetFeedbackByUserIDAndRideID(d, userIDInt, rideIDInt)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	feedbacks, err := db.GetFeedbackByUserIDAndRideID(d, userIDInt, rideIDInt, page)
 	if err != nil {
 		log.WithError(err).Error("getting user ride feedback")
 		error, status := db.SqlErrorToHTTP(err)
@@ -175,7 +199,7 @@ func createFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if feedback.UserID != userAuth.UserID && ride.OwnerID == userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if feedback.UserID != userAuth.UserID && !userAuth.Can(core.PermFeedbackWriteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -204,7 +228,7 @@ func createFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d
 		return
 	}
 
-	if err := feedback.Validate(ride, passengers, userAuth.Role); err != nil {
+	if err := feedback.Validate(ride, passengers, userAuth.Can(core.PermFeedbackWriteAny)); err != nil {
 		log.WithError(err).Error("validating feedback")
 		http.Error(w, fmt.Sprintf("validating request: %s", err.Error()), http.StatusBadRequest)
 		return
@@ -259,7 +283,7 @@ func updateFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d
 	feedback.RideID = existingFeedback.RideID
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if feedback.UserID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if feedback.UserID != userAuth.UserID && !userAuth.Can(core.PermFeedbackWriteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -280,7 +304,7 @@ func updateFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d
 		return
 	}
 
-	if err := feedback.Validate(ride, passengers, userAuth.Role); err != nil {
+	if err := feedback.Validate(ride, passengers, userAuth.Can(core.PermFeedbackWriteAny)); err != nil {
 		log.WithError(err).Error("validating feedback")
 		http.Error(w, fmt.Sprintf("while validating request: %s", err.Error()), http.StatusBadRequest)
 		return
@@ -321,7 +345,7 @@ func deleteFeedback(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if feedback.UserID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if feedback.UserID != userAuth.UserID && !userAuth.Can(core.PermFeedbackWriteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -11,6 +11,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const apiKeyHeader = "X-API-Key"
+
 func loggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log := core.SetupLogging()
@@ -32,41 +34,85 @@ func withMiddleware(handler func(http.ResponseWriter, *http.Request, *logrus.Ent
 	}
 }
 
-func authMiddleware(secret, role string, next http.Handler) http.HandlerFunc {
+// withoutAPIKey keeps API keys away from the endpoints that control the
+// account itself, so a leaked key can't be used to take it over.
+func withoutAPIKey(handler func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB)) func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB) {
+	return func(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+		userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+		if userAuth.APIKeyID != 0 {
+			http.Error(w, "API keys can't manage the account", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r, log, d)
+	}
+}
+
+// authMiddleware requires a valid access token or API key whose user holds
+// the permission. An empty permission only requires the user to be logged in.
+// API keys are further limited to their scopes. Only API key requests are
+// rate limited and only unknown keys count as failed attempts, access tokens
+// are signed and can't be guessed.
+func authMiddleware(keys *auth.Keyring, limiter *auth.Limiter, permission string, next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log := r.Context().Value(core.CtxLog).(*logrus.Entry)
+		db := r.Context().Value(core.CtxDB).(*sql.DB)
 
-		authorization := r.Header.Get("Authorization")
-		if authorization == "" {
-			http.Error(w, "missing Authorization header", http.StatusUnauthorized)
-			return
-		}
+		apiKey := r.Header.Get(apiKeyHeader)
 
-		authorizationParts := strings.Split(authorization, " ")
-		if len(authorizationParts) != 2 {
-			http.Error(w, "invalid Authorization header", http.StatusUnauthorized)
-			return
-		}
+		var token string
+		if apiKey == "" {
+			authorization := r.Header.Get("Authorization")
+			if authorization == "" {
+				http.Error(w, "missing Authorization header", http.StatusUnauthorized)
+				return
+			}
 
-		if authorizationParts[0] != "Bearer" {
-			http.Error(w, "invalid Authorization type", http.StatusUnauthorized)
-			return
-		}
+			authorizationParts := strings.Split(authorization, " ")
+			if len(authorizationParts) != 2 {
+				http.Error(w, "invalid Authorization header", http.StatusUnauthorized)
+				return
+			}
 
-		token := authorizationParts[1]
-		if token == "" {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
+			if authorizationParts[0] != "Bearer" {
+				http.Error(w, "invalid Authorization type", http.StatusUnauthorized)
+				return
+			}
+
+			token = authorizationParts[1]
+			if token == "" {
+				http.Error(w, "missing token", http.StatusUnauthorized)
+				return
+			}
 		}
 
-		auth, err := auth.GetUserDetailsAndValidate(token, role, secret)
+		var userAuth *core.UserAuth
+		var err error
+		if apiKey != "" {
+			// a locked out client can't keep guessing keys
+			if !limiter.Allow(w, r, log, "") {
+				return
+			}
+
+			userAuth, err = auth.GetAPIKeyAuth(db, apiKey)
+			if err == auth.ErrInvalidAPIKey {
+				limiter.Fail(r, log, "")
+			}
+		} else {
+			userAuth, err = auth.GetUserDetailsAndValidate(db, token, keys)
+		}
 		if err != nil {
 			log.WithError(err).Error("getting user auth")
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), core.CtxAuth, auth)
+		if !userAuth.Can(permission) || !userAuth.CanRequest(r.Method) {
+			http.Error(w, "unauthorized", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), core.CtxAuth, userAuth)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
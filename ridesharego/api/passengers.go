@@ -2,11 +2,15 @@ package api
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
 	"main/core"
 	"main/db"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -37,29 +41,51 @@ func getRidePassengers(w http.ResponseWriter, r *http.Request, log *logrus.Entry
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if ride.OwnerID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
-		http.Error(w, "unauthorized", http.StatusForbidden)
-		return
+	if ride.OwnerID != userAuth.UserID && !userAuth.Can(core.PermPassengerReadAny) {
+		_, err := db.GetPassengerByRideIDAndUserID(d, rideIDInt, userAuth.UserID)
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "user is not a passenger", http.StatusForbidden)
+			return
+		case err != nil:
+			log.WithError(err).Error("getting ride passenger")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, error, status)
+			return
+		}
 	}
 
-	passengers, err := db.GetPassengersByRideID(d, rideIDInt)
+	page, err := parsePageRequest(r)
 	if err != nil {
-		log.WithError(err).Error("getting ride passengers")
-		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, error, status)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	passengerFound := false
-	for _, passenger := range passengers {
-		if passenger.PassengerID == userAuth.UserID {
-			passengerFound = true
-			break
+	var filter core.PassengerFilter
+	if status := r.URL.Query().Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			s = strings.TrimSpace(s)
+			if !core.ValidPassengerStatus(s) {
+				http.Error(w, fmt.Sprintf("invalid status %q", s), http.StatusBadRequest)
+				return
+			}
+			filter.Statuses = append(filter.Statuses, s)
 		}
 	}
 
-	if !passengerFound && userAuth.Role != core.RoleAdmin {
-		http.Error(w, "user is not a passenger", http.StatusForbidden)
+	if minReliability := r.URL.Query().Get("min_reliability"); minReliability != "" {
+		filter.MinReliability, err = strconv.Atoi(minReliability)
+		if err != nil || filter.MinReliability < 0 || filter.MinReliability > 100 {
+			http.Error(w, "invalid min_reliability", http.StatusBadRequest)
+			return
+		}
+	}
+
+	passengers, err := db.GetPassengersPageByRideID(d, rideIDInt, filter, page)
+	if err != nil {
+		log.WithError(err).Error("getting ride passengers")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
 		return
 	}
 
@@ -96,15 +122,20 @@ func createRidePassenger(w http.ResponseWriter, r *http.Request, log *logrus.Ent
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if userIDInt != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if userIDInt != userAuth.UserID && !userAuth.Can(core.PermPassengerWriteAny) {
 		http.Error(w, "user is not the passenger", http.StatusForbidden)
 		return
 	}
 
-	passenger := core.Passenger{
-		RideID:      rideIDInt,
-		PassengerID: userIDInt,
+	// the body is optional, without it one seat is booked
+	passenger := core.Passenger{Seats: 1}
+	if err := json.NewDecoder(r.Body).Decode(&passenger); err != nil && err != io.EOF {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
 	}
+	passenger.RideID = rideIDInt
+	passenger.PassengerID = userIDInt
 
 	_, err = db.GetUserByID(d, int64(userIDInt))
 	if err != nil {
@@ -114,65 +145,105 @@ func createRidePassenger(w http.ResponseWriter, r *http.Request, log *logrus.Ent
 		return
 	}
 
-	ride, err := db.GetRideByID(d, rideIDInt)
+	// the checks run inside the booking transaction, so two bookings can't
+	// both take the last seat
+	var invalid error
+	booking, err := db.BookSeat(d, passenger, func(ride *core.Ride, passengers []core.Passenger) error {
+		invalid = passenger.Validate(ride, passengers)
+		return invalid
+	})
+	if invalid != nil {
+		log.WithError(invalid).Error("validating request")
+		http.Error(w, fmt.Sprintf("while validating request: %s", invalid.Error()), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.WithError(err).Error("getting ride")
+		log.WithError(err).Error("creating ride passenger")
 		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, fmt.Sprintf("getting ride: %s", error), status)
+		http.Error(w, error, status)
 		return
 	}
 
-	passengers, err := db.GetPassengersByRideID(d, rideIDInt)
-	if err != nil {
-		log.WithError(err).Error("getting ride passengers")
-		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, fmt.Sprintf("getting ride passengers: %s", error), status)
+	w.WriteHeader(http.StatusCreated)
+	respond(w, r, booking)
+}
+
+func deleteRidePassenger(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	vars := mux.Vars(r)
+	rideID := vars["ride_id"]
+	userID := vars["user_id"]
+
+	if rideID == "" {
+		http.Error(w, "missing ride_id", http.StatusBadRequest)
 		return
 	}
 
-	car, err := db.GetCarByID(d, ride.VehicleID)
+	if userID == "" {
+		http.Error(w, "missing user_id", http.StatusBadRequest)
+		return
+	}
+
+	rideIDInt, err := strconv.Atoi(rideID)
 	if err != nil {
-		log.WithError(err).Error("getting car")
-		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, fmt.Sprintf("getting car: %s", error), status)
+		log.WithError(err).Error("parsing ride_id")
+		http.Error(w, "invalid ride_id", http.StatusBadRequest)
 		return
 	}
 
-	model, err := db.GetCarModelByID(d, car.ModelID)
+	userIDInt, err := strconv.Atoi(userID)
 	if err != nil {
-		log.WithError(err).Error("getting car model")
-		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, fmt.Sprintf("getting car model: %s", error), status)
+		log.WithError(err).Error("parsing user_id")
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
 		return
 	}
 
-	category, err := db.GetCarCategoryByID(d, model.CategoryID)
+	ride, err := db.GetRideByID(d, rideIDInt)
 	if err != nil {
-		log.WithError(err).Error("getting car category")
+		log.WithError(err).Error("getting ride")
 		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, fmt.Sprintf("getting car category: %s", error), status)
+		http.Error(w, fmt.Sprintf("getting ride: %s", error), status)
 		return
 	}
 
-	if err := passenger.Validate(ride, passengers, category.PassengerCount); err != nil {
-		log.WithError(err).Error("validating request")
-		http.Error(w, fmt.Sprintf("while validating request: %s", err.Error()), http.StatusBadRequest)
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	if userIDInt != userAuth.UserID && ride.OwnerID != userAuth.UserID && !userAuth.Can(core.PermPassengerWriteAny) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	err = db.CreatePassenger(d, passenger)
+	// the checks run inside the removal transaction, so neither the ride nor
+	// the booking can change before the booking is removed
+	var conflict error
+	promoted, err := db.DeletePassenger(d, rideIDInt, userIDInt, func(ride *core.Ride, booking *core.Passenger) (bool, error) {
+		// passengers of started and finished rides are kept for the feedback
+		if ride.Status != core.RideScheduled && ride.Status != core.RideBoarding {
+			conflict = fmt.Errorf("ride is %s", ride.Status)
+			return false, conflict
+		}
+
+		// only passengers leaving a confirmed seat after the cut-off cancel
+		// late, not the driver removing them
+		if userIDInt != userAuth.UserID || booking.Status != core.PassengerAccepted {
+			return false, nil
+		}
+		return ride.LateCancellation(time.Now())
+	})
+	if conflict != nil {
+		http.Error(w, conflict.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		log.WithError(err).Error("creating ride passenger")
+		log.WithError(err).Error("deleting ride passenger")
 		error, status := db.SqlErrorToHTTP(err)
 		http.Error(w, error, status)
 		return
 	}
+	notifyPromoted(r, log, d, ride, promoted)
 
-	w.WriteHeader(http.StatusCreated)
-	respond(w, r, passenger)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func deleteRidePassenger(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+func reportNoShow(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
 	vars := mux.Vars(r)
 	rideID := vars["ride_id"]
 	userID := vars["user_id"]
@@ -210,24 +281,38 @@ func deleteRidePassenger(w http.ResponseWriter, r *http.Request, log *logrus.Ent
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if userIDInt != userAuth.UserID && ride.OwnerID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if ride.OwnerID != userAuth.UserID && !userAuth.Can(core.PermPassengerWriteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	if _, err := db.GetPassengerByRideIDAndUserID(d, rideIDInt, userIDInt); err != nil {
+	// a passenger can only miss a ride that has left
+	if ride.Status != core.RideInProgress && ride.Status != core.RideCompleted {
+		http.Error(w, fmt.Sprintf("ride is %s", ride.Status), http.StatusConflict)
+		return
+	}
+
+	passenger, err := db.GetPassengerByRideIDAndUserID(d, rideIDInt, userIDInt)
+	if err != nil {
 		log.WithError(err).Error("getting ride passenger")
 		error, status := db.SqlErrorToHTTP(err)
 		http.Error(w, fmt.Sprintf("getting ride passenger: %s", error), status)
 		return
 	}
 
-	if err := db.DeletePassenger(d, rideIDInt, userIDInt); err != nil {
-		log.WithError(err).Error("deleting ride passenger")
+	if passenger.Status != core.PassengerAccepted {
+		http.Error(w, fmt.Sprintf("booking is %s", passenger.Status), http.StatusConflict)
+		return
+	}
+
+	incident, err := db.ReportNoShow(d, rideIDInt, userIDInt)
+	if err != nil {
+		log.WithError(err).Error("reporting no-show")
 		error, status := db.SqlErrorToHTTP(err)
 		http.Error(w, error, status)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	w.WriteHeader(http.StatusCreated)
+	respond(w, r, incident)
 }
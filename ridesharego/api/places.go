@@ -0,0 +1,68 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"main/core"
+	"main/geo"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPlaceLimit = 10
+	maxPlaceLimit     = 50
+)
+
+// getPlaces suggests cities for autocomplete from the name typed so far.
+func getPlaces(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	query := r.URL.Query()
+
+	prefix := geo.CleanName(query.Get("q"))
+	if prefix == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parsePlaceLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	respond(w, r, gazetteer(r).Suggest(prefix, limit))
+}
+
+func parsePlaceLimit(value string) (int, error) {
+	if value == "" {
+		return defaultPlaceLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid limit")
+	}
+
+	return min(limit, maxPlaceLimit), nil
+}
+
+func gazetteer(r *http.Request) *geo.Gazetteer {
+	return r.Context().Value(core.CtxGazetteer).(*geo.Gazetteer)
+}
+
+// geocodeRide replaces the cities of the ride with their gazetteer names and
+// fills in their coordinates if the ride was sent without any. Cities that
+// aren't in the gazetteer are kept as sent and the ride stays without
+// coordinates.
+func geocodeRide(g *geo.Gazetteer, ride *core.Ride) {
+	startCity, start := g.Normalize(ride.StartCity)
+	endCity, end := g.Normalize(ride.EndCity)
+	ride.StartCity, ride.EndCity = startCity, endCity
+
+	if ride.StartLocation == nil && ride.EndLocation == nil && start != nil && end != nil {
+		ride.StartLocation = &start.Location
+		ride.EndLocation = &end.Location
+	}
+}
@@ -3,18 +3,47 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"main/core"
 	"main/db"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
+// radius searches in km
+const (
+	defaultSearchRadius = 10
+	maxSearchRadius     = 500
+)
+
+// cancelled rides are only found when asked for
+var defaultSearchStatuses = []string{core.RideScheduled, core.RideBoarding, core.RideInProgress, core.RideCompleted}
+
 func getRides(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
-	rides, err := db.GetRides(d)
+	filter, err := parseRideFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// cities are stored by their gazetteer name, other spellings find them too
+	filter.StartCity, _ = gazetteer(r).Normalize(filter.StartCity)
+	filter.EndCity, _ = gazetteer(r).Normalize(filter.EndCity)
+
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rides, err := db.GetRides(d, filter, page)
 	if err != nil {
 		log.WithError(err).Error("getting rides")
 		error, status := db.SqlErrorToHTTP(err)
@@ -25,6 +54,133 @@ func getRides(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.
 	respond(w, r, rides)
 }
 
+// parseRideFilter reads the search parameters of the rides list. Dates are
+// either a date or a date and time, date_to without a time includes the
+// whole day. leaving_within such as "3h" searches rides starting from now
+// until then instead. Radius searches take a point and a radius in km.
+// Cancelled rides are left out unless status asks for them.
+func parseRideFilter(query url.Values) (core.RideFilter, error) {
+	filter := core.RideFilter{
+		StartCity:    strings.TrimSpace(query.Get("start_city")),
+		StartAddress: strings.TrimSpace(query.Get("start_address")),
+		EndCity:      strings.TrimSpace(query.Get("end_city")),
+		EndAddress:   strings.TrimSpace(query.Get("end_address")),
+	}
+
+	if dateFrom := query.Get("date_from"); dateFrom != "" {
+		from, _, err := parseSearchDate(dateFrom)
+		if err != nil {
+			return filter, errors.New("invalid date_from")
+		}
+		filter.DateFrom = from.Format(time.DateTime)
+	}
+
+	if dateTo := query.Get("date_to"); dateTo != "" {
+		to, dateOnly, err := parseSearchDate(dateTo)
+		if err != nil {
+			return filter, errors.New("invalid date_to")
+		}
+		if dateOnly {
+			to = to.Add(24*time.Hour - time.Second)
+		}
+		filter.DateTo = to.Format(time.DateTime)
+	}
+
+	if leavingWithin := query.Get("leaving_within"); leavingWithin != "" {
+		within, err := time.ParseDuration(leavingWithin)
+		if err != nil || within <= 0 {
+			return filter, errors.New("invalid leaving_within")
+		}
+		now := time.Now()
+		filter.DateFrom = now.Format(time.DateTime)
+		filter.DateTo = now.Add(within).Format(time.DateTime)
+	}
+
+	if filter.DateFrom != "" && filter.DateTo != "" && filter.DateFrom > filter.DateTo {
+		return filter, errors.New("date_from is after date_to")
+	}
+
+	if minFreeSeats := query.Get("min_free_seats"); minFreeSeats != "" {
+		seats, err := strconv.Atoi(minFreeSeats)
+		if err != nil || seats < 0 {
+			return filter, errors.New("invalid min_free_seats")
+		}
+		filter.MinFreeSeats = seats
+	}
+
+	if status := query.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			s = strings.TrimSpace(s)
+			if !core.ValidRideStatus(s) {
+				return filter, fmt.Errorf("invalid status %q", s)
+			}
+			filter.Statuses = append(filter.Statuses, s)
+		}
+	} else {
+		filter.Statuses = defaultSearchStatuses
+	}
+
+	var err error
+	if filter.StartNear, filter.StartRadius, err = parseNear(query, "start"); err != nil {
+		return filter, err
+	}
+
+	if filter.EndNear, filter.EndRadius, err = parseNear(query, "end"); err != nil {
+		return filter, err
+	}
+
+	if owner := query.Get("owner"); owner != "" {
+		ownerID, err := strconv.Atoi(owner)
+		if err != nil || ownerID <= 0 {
+			return filter, errors.New("invalid owner")
+		}
+		filter.OwnerID = ownerID
+	}
+
+	return filter, nil
+}
+
+// parseNear reads the <prefix>_lat, <prefix>_lng and <prefix>_radius
+// parameters, the radius is returned in meters.
+func parseNear(query url.Values, prefix string) (*core.GeoPoint, float64, error) {
+	lat, lng := query.Get(prefix+"_lat"), query.Get(prefix+"_lng")
+	if lat == "" && lng == "" {
+		return nil, 0, nil
+	}
+
+	var point core.GeoPoint
+	var err error
+	if point.Lat, err = strconv.ParseFloat(lat, 64); err != nil {
+		return nil, 0, fmt.Errorf("invalid %s_lat", prefix)
+	}
+
+	if point.Lng, err = strconv.ParseFloat(lng, 64); err != nil {
+		return nil, 0, fmt.Errorf("invalid %s_lng", prefix)
+	}
+
+	if err := point.Validate(); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", prefix, err)
+	}
+
+	radius := float64(defaultSearchRadius)
+	if value := query.Get(prefix + "_radius"); value != "" {
+		if radius, err = strconv.ParseFloat(value, 64); err != nil || radius <= 0 || radius > maxSearchRadius {
+			return nil, 0, fmt.Errorf("invalid %s_radius", prefix)
+		}
+	}
+
+	return &point, radius * 1000, nil
+}
+
+func parseSearchDate(value string) (time.Time, bool, error) {
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, true, nil
+	}
+
+	date, err := time.Parse(time.DateTime, value)
+	return date, false, err
+}
+
 func getRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
 	vars := mux.Vars(r)
 	id := vars["ride_id"]
@@ -61,12 +217,12 @@ func createRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if ride.OwnerID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if ride.OwnerID != userAuth.UserID && !userAuth.Can(core.PermRideUpdateAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	_, err := db.GetUserByID(d, int64(ride.OwnerID))
+	owner, err := db.GetUserByID(d, int64(ride.OwnerID))
 	if err != nil {
 		log.WithError(err).Error("getting user")
 		error, status := db.SqlErrorToHTTP(err)
@@ -74,6 +230,11 @@ func createRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 
+	if !owner.EmailVerified() {
+		http.Error(w, "email not verified", http.StatusForbidden)
+		return
+	}
+
 	car, err := db.GetCarByID(d, ride.VehicleID)
 	if err != nil {
 		log.WithError(err).Error("getting car")
@@ -82,7 +243,22 @@ func createRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 
-	if err := ride.Validate(car); err != nil {
+	category, err := db.GetCarCategoryByCarID(d, car.ID)
+	if err != nil {
+		log.WithError(err).Error("getting car category")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, fmt.Sprintf("while getting car category: %s", error), status)
+		return
+	}
+
+	// without a seat count every seat but the driver's is offered
+	if ride.SeatsOffered == 0 {
+		ride.SeatsOffered = category.PassengerCount - 1
+	}
+
+	geocodeRide(gazetteer(r), &ride)
+
+	if err := ride.Validate(car, category); err != nil {
 		log.WithError(err).Error("validating request")
 		http.Error(w, fmt.Sprintf("validating request: %s", err.Error()), http.StatusBadRequest)
 		return
@@ -96,6 +272,9 @@ func createRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 	ride.ID = int(id)
+	ride.SeatsTaken, ride.SeatsFree = 0, ride.SeatsOffered
+	ride.Status = core.RideScheduled
+	ride.BoardingAt, ride.StartedAt, ride.CompletedAt, ride.CancelledAt = nil, nil, nil, nil
 
 	w.WriteHeader(http.StatusCreated)
 	respond(w, r, ride)
@@ -124,8 +303,18 @@ func updateRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 
+	existingRide, err := db.GetRideByID(d, idInt)
+	if err != nil {
+		log.WithError(err).Error("getting ride")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, fmt.Sprintf("while getting ride: %s", error), status)
+		return
+	}
+
+	// both the current and the new owner are checked so rides can't be
+	// taken over by sending a different owner_user_id
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if ride.OwnerID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if (existingRide.OwnerID != userAuth.UserID || ride.OwnerID != userAuth.UserID) && !userAuth.Can(core.PermRideUpdateAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -146,25 +335,47 @@ func updateRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 
-	if err := ride.Validate(car); err != nil {
+	category, err := db.GetCarCategoryByCarID(d, car.ID)
+	if err != nil {
+		log.WithError(err).Error("getting car category")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, fmt.Sprintf("while getting car category: %s", error), status)
+		return
+	}
+
+	// without a seat count every seat but the driver's is offered
+	if ride.SeatsOffered == 0 {
+		ride.SeatsOffered = category.PassengerCount - 1
+	}
+
+	geocodeRide(gazetteer(r), &ride)
+
+	if err := ride.Validate(car, category); err != nil {
 		log.WithError(err).Error("validating request")
 		http.Error(w, fmt.Sprintf("validating request: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
 
-	if _, err := db.GetRideByID(d, idInt); err != nil {
-		log.WithError(err).Error("getting ride")
-		error, status := db.SqlErrorToHTTP(err)
-		http.Error(w, fmt.Sprintf("while getting ride: %s", error), status)
+	// the status is checked again with the ride locked, so it can't start in
+	// between
+	var conflict error
+	promoted, err := db.UpdateRide(d, idInt, ride, func(existing *core.Ride, passengers []core.Passenger) error {
+		if existing.Status != core.RideScheduled {
+			conflict = fmt.Errorf("ride is %s and can no longer be changed", existing.Status)
+		}
+		return conflict
+	})
+	if conflict != nil {
+		http.Error(w, conflict.Error(), http.StatusConflict)
 		return
 	}
-
-	if err := db.UpdateRide(d, idInt, ride); err != nil {
+	if err != nil {
 		log.WithError(err).Error("updating ride")
 		error, status := db.SqlErrorToHTTP(err)
 		http.Error(w, error, status)
 		return
 	}
+	notifyPromoted(r, log, d, &ride, promoted)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -194,12 +405,26 @@ func deleteRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if userAuth.UserID != ride.OwnerID && userAuth.Role != core.RoleAdmin {
+	if userAuth.UserID != ride.OwnerID && !userAuth.Can(core.PermRideDeleteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	if err := db.DeleteRide(d, idInt); err != nil {
+	// deleting also deletes the passengers and feedback, owners cancel rides
+	// that have any instead. Checked with the ride locked, so no booking can
+	// come in between.
+	var conflict error
+	err = db.DeleteRide(d, idInt, func(ride *core.Ride, passengers []core.Passenger) error {
+		if !userAuth.Can(core.PermRideDeleteAny) && (ride.Status != core.RideScheduled || len(passengers) > 0) {
+			conflict = errors.New("ride has passengers or has started, cancel it instead")
+		}
+		return conflict
+	})
+	if conflict != nil {
+		http.Error(w, conflict.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		log.WithError(err).Error("deleting ride")
 		error, status := db.SqlErrorToHTTP(err)
 		http.Error(w, error, status)
@@ -208,3 +433,60 @@ func deleteRide(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// transitionRide returns the handler that moves a ride to the status, only
+// the owner can.
+func transitionRide(to string) func(http.ResponseWriter, *http.Request, *logrus.Entry, *sql.DB) {
+	return func(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+		vars := mux.Vars(r)
+		id := vars["ride_id"]
+
+		if id == "" {
+			http.Error(w, "missing id", http.StatusBadRequest)
+			return
+		}
+
+		idInt, err := strconv.Atoi(id)
+		if err != nil {
+			log.WithError(err).Error("parsing id")
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+
+		ride, err := db.GetRideByID(d, idInt)
+		if err != nil {
+			log.WithError(err).Error("getting ride")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, fmt.Sprintf("while getting ride: %s", error), status)
+			return
+		}
+
+		userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+		if userAuth.UserID != ride.OwnerID && !userAuth.Can(core.PermRideUpdateAny) {
+			http.Error(w, "unauthorized", http.StatusForbidden)
+			return
+		}
+
+		if err := ride.CanTransition(to); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if err := db.TransitionRide(d, idInt, ride.Status, to); err != nil {
+			log.WithError(err).Error("changing ride status")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, error, status)
+			return
+		}
+
+		ride, err = db.GetRideByID(d, idInt)
+		if err != nil {
+			log.WithError(err).Error("getting ride")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, fmt.Sprintf("while getting ride: %s", error), status)
+			return
+		}
+
+		respond(w, r, ride)
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"database/sql"
+	"main/core"
+	"main/db"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func getRoles(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	respond(w, r, core.Roles())
+}
+
+func getUserRoles(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	vars := mux.Vars(r)
+	id := vars["user_id"]
+
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		log.WithError(err).Error("parsing id")
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	if idInt != userAuth.UserID && !userAuth.Can(core.PermUserReadAny) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+
+	roles, err := db.GetUserRoles(d, idInt)
+	if err != nil {
+		log.WithError(err).Error("getting user roles")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	respond(w, r, core.NewUserAuth(idInt, "", roles).UserRoles())
+}
+
+func grantUserRole(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, role, ok := parseUserRole(w, r, log)
+	if !ok {
+		return
+	}
+
+	if _, err := db.GetUserByID(d, int64(userID)); err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	if err := db.GrantUserRole(d, userID, role); err != nil {
+		log.WithError(err).Error("granting role")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func revokeUserRole(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, role, ok := parseUserRole(w, r, log)
+	if !ok {
+		return
+	}
+
+	if err := db.RevokeUserRole(d, userID, role); err != nil {
+		log.WithError(err).Error("revoking role")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseUserRole reads the user and role of the grant endpoints. The base
+// user role is held by everyone and can't be granted or revoked.
+func parseUserRole(w http.ResponseWriter, r *http.Request, log *logrus.Entry) (int, string, bool) {
+	vars := mux.Vars(r)
+
+	userID, err := strconv.Atoi(vars["user_id"])
+	if err != nil {
+		log.WithError(err).Error("parsing user_id")
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return 0, "", false
+	}
+
+	role := vars["role"]
+	if !core.ValidRole(role) || role == core.RoleUser {
+		http.Error(w, "invalid role", http.StatusBadRequest)
+		return 0, "", false
+	}
+
+	return userID, role, true
+}
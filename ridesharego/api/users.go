@@ -4,17 +4,25 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"main/auth"
 	"main/core"
 	"main/db"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
 func getUsers(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
-	users, err := db.GetUsers(d)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, err := db.GetUsers(d, page)
 	if err != nil {
 		log.WithError(err).Error("getting users")
 		error, status := db.SqlErrorToHTTP(err)
@@ -22,7 +30,16 @@ func getUsers(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.
 		return
 	}
 
-	respond(w, r, users)
+	profiles := core.Page[core.UserProfile]{
+		Items:      make([]core.UserProfile, 0, len(users.Items)),
+		NextCursor: users.NextCursor,
+		Total:      users.Total,
+	}
+	for _, user := range users.Items {
+		profiles.Items = append(profiles.Items, user.Profile())
+	}
+
+	respond(w, r, profiles)
 }
 
 func getUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
@@ -50,12 +67,28 @@ func getUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.D
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if user.ID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
-		http.Error(w, "unauthorized", http.StatusForbidden)
+	if user.ID == userAuth.UserID || userAuth.Can(core.PermUserReadAny) {
+		respond(w, r, user.Profile())
+		return
+	}
+
+	rating, err := db.GetUserRating(d, user.ID)
+	if err != nil {
+		log.WithError(err).Error("getting user rating")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	reliability, err := db.GetUserReliability(d, user.ID)
+	if err != nil {
+		log.WithError(err).Error("getting user reliability")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
 		return
 	}
 
-	respond(w, r, user)
+	respond(w, r, user.PublicProfile(*rating, *reliability))
 }
 
 func createUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
@@ -65,12 +98,39 @@ func createUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 
+	user.Name = strings.TrimSpace(user.Name)
+	user.Email = core.NormalizeEmail(user.Email)
+
 	if err := user.Validate(); err != nil {
 		log.WithError(err).Error("validating user")
 		http.Error(w, fmt.Sprintf("validating user: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
 
+	if err := core.ValidatePassword(user.Password); err != nil {
+		http.Error(w, fmt.Sprintf("validating user: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if user.Role != "" && !core.ValidRole(user.Role) {
+		http.Error(w, "invalid role", http.StatusBadRequest)
+		return
+	}
+
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	if user.Role != "" && user.Role != core.RoleUser && !userAuth.Can(core.PermRoleGrant) {
+		http.Error(w, "invalid permissions", http.StatusForbidden)
+		return
+	}
+
+	hash, err := auth.HashPassword(user.Password)
+	if err != nil {
+		log.WithError(err).Error("hashing password")
+		http.Error(w, "hashing password", http.StatusInternalServerError)
+		return
+	}
+	user.Password = hash
+
 	id, err := db.CreateUser(d, user)
 	if err != nil {
 		log.WithError(err).Error("creating user")
@@ -78,10 +138,17 @@ func createUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		http.Error(w, error, status)
 		return
 	}
-	user.ID = int(id)
+
+	created, err := db.GetUserByID(d, id)
+	if err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
-	respond(w, r, user)
+	respond(w, r, created.Profile())
 }
 
 func updateUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
@@ -107,12 +174,22 @@ func updateUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 
-	if err := userUpdate.Validate(); err != nil {
+	userUpdate.Name = strings.TrimSpace(userUpdate.Name)
+	userUpdate.Email = core.NormalizeEmail(userUpdate.Email)
+
+	if err := userUpdate.ValidateProfile(); err != nil {
 		log.WithError(err).Error("validating user")
 		http.Error(w, fmt.Sprintf("validating user: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
 
+	if userUpdate.Password != "" {
+		if err := core.ValidatePassword(userUpdate.Password); err != nil {
+			http.Error(w, fmt.Sprintf("validating user: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
 	existingUser, err := db.GetUserByID(d, int64(idInt))
 	if err != nil {
 		log.WithError(err).Error("getting user")
@@ -122,11 +199,36 @@ func updateUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if existingUser.Role != userUpdate.Role && userAuth.UserID != existingUser.ID && userAuth.Role != core.RoleAdmin {
+	if existingUser.ID != userAuth.UserID && !userAuth.Can(core.PermUserUpdateAny) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+
+	if userUpdate.Role == "" {
+		userUpdate.Role = existingUser.Role
+	}
+
+	if !core.ValidRole(userUpdate.Role) {
+		http.Error(w, "invalid role", http.StatusBadRequest)
+		return
+	}
+
+	// users can't promote themselves, changing a role always needs role:grant
+	if existingUser.Role != userUpdate.Role && !userAuth.Can(core.PermRoleGrant) {
 		http.Error(w, "invalid permissions", http.StatusForbidden)
 		return
 	}
 
+	// the password is only changed when a new one is sent
+	if userUpdate.Password != "" {
+		userUpdate.Password, err = auth.HashPassword(userUpdate.Password)
+		if err != nil {
+			log.WithError(err).Error("hashing password")
+			http.Error(w, "hashing password", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	if err := db.UpdateUser(d, int64(idInt), userUpdate); err != nil {
 		log.WithError(err).Error("updating user")
 		error, status := db.SqlErrorToHTTP(err)
@@ -134,6 +236,16 @@ func updateUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 		return
 	}
 
+	// whoever knew the old password or owns the old address is logged out
+	if userUpdate.Password != "" || userUpdate.Email != existingUser.Email {
+		if err := db.RevokeSessionsByUserID(d, existingUser.ID); err != nil {
+			log.WithError(err).Error("revoking sessions")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, error, status)
+			return
+		}
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -162,7 +274,7 @@ func deleteUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sq
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if existingUser.ID != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if existingUser.ID != userAuth.UserID && !userAuth.Can(core.PermUserDeleteAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
@@ -194,12 +306,18 @@ func getUserRides(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if idInt != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if idInt != userAuth.UserID && !userAuth.Can(core.PermRideReadAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	rides, err := db.GetRidesByUserID(d, idInt)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rides, err := db.GetRidesByUserID(d, idInt, page)
 	if err != nil {
 		log.WithError(err).Error("getting user rides")
 		error, status := db.SqlErrorToHTTP(err)
@@ -227,12 +345,18 @@ func getUserCars(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *s
 	}
 
 	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
-	if idInt != userAuth.UserID && userAuth.Role != core.RoleAdmin {
+	if idInt != userAuth.UserID && !userAuth.Can(core.PermCarReadAny) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
 
-	cars, err := db.GetCarsByUserID(d, idInt)
+	page, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cars, err := db.GetCarsPageByUserID(d, idInt, page)
 	if err != nil {
 		log.WithError(err).Error("getting user rides")
 		error, status := db.SqlErrorToHTTP(err)
@@ -240,7 +364,7 @@ func getUserCars(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *s
 		return
 	}
 
-	if len(cars) == 0 {
+	if cars.Total == 0 {
 		http.Error(w, "no cars found", http.StatusNotFound)
 		return
 	}
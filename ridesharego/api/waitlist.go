@@ -0,0 +1,138 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"main/core"
+	"main/db"
+	"main/mail"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// joinWaitlist puts the caller in line for seats on a full ride.
+func joinWaitlist(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	rideIDInt, err := strconv.Atoi(mux.Vars(r)["ride_id"])
+	if err != nil {
+		log.WithError(err).Error("parsing ride_id")
+		http.Error(w, "invalid ride_id", http.StatusBadRequest)
+		return
+	}
+
+	// the body is optional, without it one seat is requested
+	entry := core.WaitlistEntry{Seats: 1}
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil && err != io.EOF {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	entry.RideID = rideIDInt
+	entry.UserID = userAuth.UserID
+
+	var invalid error
+	created, err := db.JoinWaitlist(d, entry, func(ride *core.Ride, passengers []core.Passenger) error {
+		invalid = entry.Validate(ride, passengers)
+		return invalid
+	})
+	if invalid != nil {
+		log.WithError(invalid).Error("validating request")
+		http.Error(w, fmt.Sprintf("while validating request: %s", invalid.Error()), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("joining waitlist")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	respond(w, r, created)
+}
+
+// getWaitlistPosition returns the caller's place in the line of a ride.
+func getWaitlistPosition(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	rideIDInt, err := strconv.Atoi(mux.Vars(r)["ride_id"])
+	if err != nil {
+		log.WithError(err).Error("parsing ride_id")
+		http.Error(w, "invalid ride_id", http.StatusBadRequest)
+		return
+	}
+
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	entry, err := db.GetWaitlistEntry(d, rideIDInt, userAuth.UserID)
+	if err != nil {
+		log.WithError(err).Error("getting waitlist entry")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	respond(w, r, entry)
+}
+
+func leaveWaitlist(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	rideIDInt, err := strconv.Atoi(mux.Vars(r)["ride_id"])
+	if err != nil {
+		log.WithError(err).Error("parsing ride_id")
+		http.Error(w, "invalid ride_id", http.StatusBadRequest)
+		return
+	}
+
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+	if err := db.LeaveWaitlist(d, rideIDInt, userAuth.UserID); err != nil {
+		log.WithError(err).Error("leaving waitlist")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyPromoted emails the riders who got seats from the waitlist. The
+// emails are sent in the background, failures are only logged.
+func notifyPromoted(r *http.Request, log *logrus.Entry, d *sql.DB, ride *core.Ride, promoted []core.Passenger) {
+	mailer := r.Context().Value(core.CtxMailer).(mail.Mailer)
+	mailPromoted(mailer, log, d, ride, promoted)
+}
+
+// mailPromoted tells the riders who got seats from the waitlist in the
+// background.
+func mailPromoted(mailer mail.Mailer, log *logrus.Entry, d *sql.DB, ride *core.Ride, promoted []core.Passenger) {
+	if len(promoted) == 0 {
+		return
+	}
+
+	go func() {
+		for _, passenger := range promoted {
+			user, err := db.GetUserByID(d, int64(passenger.PassengerID))
+			if err != nil {
+				log.WithError(err).Error("getting promoted passenger")
+				continue
+			}
+
+			outcome := "You are now booked on it."
+			if passenger.Status == core.PassengerPending {
+				outcome = "Your booking now waits for the driver to accept it."
+			}
+
+			err = mailer.Send(mail.Message{
+				To:      user.Email,
+				Subject: "You got a seat from the waitlist",
+				Body: fmt.Sprintf("Hi %s,\n\nseats freed up on the ride from %s to %s on %s, and you were next on the waitlist. %s\n\nSeats: %d\n",
+					user.Name, ride.StartCity, ride.EndCity, ride.StartDate, outcome, passenger.Seats),
+			})
+			if err != nil {
+				log.WithError(err).WithField("user_id", user.ID).Error("sending waitlist email")
+			}
+		}
+	}()
+}
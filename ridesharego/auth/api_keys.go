@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"main/core"
+	"main/db"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "rsk_"
+	// apiKeyShownLength is how much of the key is stored in clear text to
+	// tell keys apart in lists
+	apiKeyShownLength = len(apiKeyPrefix) + 8
+)
+
+// ErrInvalidAPIKey is returned for keys that don't exist, which could be guesses.
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// NewAPIKey returns a random API key together with the prefix and hash it is
+// stored as.
+func NewAPIKey() (key, prefix, hash string, err error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = apiKeyPrefix + secret
+	return key, key[:apiKeyShownLength], hashToken(key), nil
+}
+
+// GetAPIKeyAuth checks the API key and returns the permissions of its user
+// limited to the scopes of the key. Like access tokens, roles are read on
+// every request.
+func GetAPIKeyAuth(d *sql.DB, key string) (*core.UserAuth, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	apiKey, err := db.GetAPIKeyByHash(d, hashToken(key))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrInvalidAPIKey
+	case err != nil:
+		return nil, err
+	}
+
+	if !apiKey.Active(time.Now()) {
+		return nil, errors.New("API key revoked or expired")
+	}
+
+	roles, err := db.GetUserRoles(d, apiKey.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.TouchAPIKey(d, apiKey.ID); err != nil {
+		return nil, err
+	}
+
+	return core.NewAPIKeyAuth(apiKey, roles), nil
+}
@@ -1,28 +1,36 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"main/core"
+	"main/db"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 )
 
 const (
-	sessionDuration = 24 * time.Hour
-	roleAdmin       = "admin"
-	roleUser        = "user"
+	accessTokenDuration  = 15 * time.Minute
+	refreshTokenDuration = 30 * 24 * time.Hour
+	tokenIssuer          = "rideshare-go"
+	tokenAudience        = "rideshare-api"
 )
 
-var permissions = map[string]int{
-	roleAdmin: 1,
-	roleUser:  2,
-}
-
-func GetUserDetailsAndValidate(tokenString, role, secret string) (*core.UserAuth, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+// GetUserDetailsAndValidate checks the access token and loads the roles of
+// its user. Roles are read from the database on every request so grants and
+// revocations apply without issuing a new token.
+func GetUserDetailsAndValidate(d *sql.DB, tokenString string, keys *Keyring) (*core.UserAuth, error) {
+	token, err := keys.Parse(tokenString)
 	if err != nil {
 		return nil, err
 	}
@@ -33,37 +41,167 @@ func GetUserDetailsAndValidate(tokenString, role, secret string) (*core.UserAuth
 			return nil, errors.New("token expired")
 		}
 
-		requiredPermission, ok := permissions[role]
-		if !ok {
-			return nil, errors.New("invalid role")
+		if !claims.VerifyAudience(tokenAudience, true) {
+			return nil, errors.New("invalid audience")
+		}
+
+		sessionID, ok := claims["sid"].(string)
+		if !ok || sessionID == "" {
+			return nil, errors.New("missing session")
+		}
+
+		// the session is checked on every request so that logging out
+		// revokes access tokens before they expire
+		session, err := db.GetSessionByID(d, sessionID)
+		if err != nil {
+			return nil, err
 		}
 
-		requestRole := claims["aud"].(string)
-		if requestRole == "" {
-			return nil, errors.New("invalid role")
+		if !session.Active(time.Now()) {
+			return nil, errors.New("session revoked")
 		}
 
-		if permissions[requestRole] > requiredPermission {
-			return nil, errors.New("insufficient role")
+		userID := int(claims["sub"].(float64))
+		roles, err := db.GetUserRoles(d, userID)
+		if err != nil {
+			return nil, err
 		}
 
-		return &core.UserAuth{
-			Role:   claims["aud"].(string),
-			UserID: int(claims["sub"].(float64)),
-		}, nil
+		return core.NewUserAuth(userID, sessionID, roles), nil
 	}
 
 	return nil, errors.New("invalid token")
 }
 
-func createToken(user *core.User, issueTime time.Time, secret string) (string, error) {
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// authenticate validates the bearer token of requests to routes registered
+// outside of the API router.
+func authenticate(d *sql.DB, r *http.Request, keys *Keyring) (*core.UserAuth, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	return GetUserDetailsAndValidate(d, token, keys)
+}
+
+// IssueTokens starts a new session for the user and returns an access token
+// together with the refresh token that can be used to renew it.
+func IssueTokens(d *sql.DB, user *core.User, issueTime time.Time, keys *Keyring) (*core.AuthToken, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshExpiresAt := issueTime.Add(refreshTokenDuration)
+	session := core.Session{
+		ID:               sessionID,
+		UserID:           user.ID,
+		RefreshTokenHash: hashToken(refreshToken),
+		ExpiresAt:        refreshExpiresAt.UTC().Format(time.DateTime),
+	}
+
+	if err := db.CreateSession(d, session); err != nil {
+		return nil, err
+	}
+
+	token, err := CreateToken(user, sessionID, issueTime, keys)
+	if err != nil {
+		return nil, err
+	}
+	token.RefreshToken = refreshToken
+	token.RefreshExpiresAt = refreshExpiresAt.Unix()
+
+	return token, nil
+}
+
+func CreateToken(user *core.User, sessionID string, issueTime time.Time, keys *Keyring) (*core.AuthToken, error) {
+	expiresAt := issueTime.Add(accessTokenDuration)
+	token, err := keys.Sign(jwt.MapClaims{
 		"sub": user.ID,
-		"iss": "rideshare-go",
-		"aud": user.Role,
-		"exp": issueTime.Add(sessionDuration).Unix(),
+		"sid": sessionID,
+		"iss": tokenIssuer,
+		"aud": tokenAudience,
+		"exp": expiresAt.Unix(),
 		"iat": issueTime.Unix(),
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.AuthToken{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: expiresAt.Unix(),
+	}, nil
+}
+
+// parsePurposeToken validates the short-lived tokens issued for a single
+// step of a flow, such as a pending 2FA login or a password reset, and
+// returns their claims and user. Every kind of token has its own audience,
+// which keeps them from being used as access tokens or in place of each other.
+func parsePurposeToken(tokenString string, keys *Keyring, audience, purpose string) (jwt.MapClaims, int, error) {
+	token, err := keys.Parse(tokenString)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, 0, errors.New("invalid token")
+	}
+
+	if !claims.VerifyAudience(audience, true) || !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, 0, errors.New("invalid token")
+	}
+
+	if claims["purpose"] != purpose {
+		return nil, 0, errors.New("invalid token purpose")
+	}
+
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return nil, 0, errors.New("missing subject")
+	}
+
+	return claims, int(sub), nil
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is used for high-entropy tokens stored server-side, which
+// unlike passwords don't need a slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type routeHandler func(http.ResponseWriter, *http.Request, *logrus.Entry)
+
+func handle(r *mux.Router, path string, handler routeHandler) *mux.Route {
+	return r.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		log := r.Context().Value(core.CtxLog).(*logrus.Entry)
+		handler(w, r, log)
+	})
+}
+
+func respond(w http.ResponseWriter, status int, data any) {
+	response, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	return claims.SignedString([]byte(secret))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
 }
@@ -0,0 +1,360 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/core"
+	"main/db"
+	"main/mail"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	emailTokenAudience    = "rideshare-email"
+	purposeVerifyEmail    = "verify_email"
+	purposeResetPassword  = "reset_password"
+	verifyEmailLifetime   = 24 * time.Hour
+	resetPasswordLifetime = time.Hour
+)
+
+var (
+	errInvalidEmailToken = errors.New("invalid or expired token")
+	errTokenUsed         = errors.New("token already used")
+)
+
+// emailModule sends the verify email and reset password links and consumes
+// their tokens. The tokens are signed JWTs that can only be used once.
+type emailModule struct {
+	db               *sql.DB
+	keys             *Keyring
+	mailer           mail.Mailer
+	verifyEmailURL   string
+	resetPasswordURL string
+	limiter          *Limiter
+}
+
+func NewEmailModule(db *sql.DB, keys *Keyring, mailer mail.Mailer, verifyEmailURL, resetPasswordURL string, limiter *Limiter) *emailModule {
+	return &emailModule{
+		db:               db,
+		keys:             keys,
+		mailer:           mailer,
+		verifyEmailURL:   verifyEmailURL,
+		resetPasswordURL: resetPasswordURL,
+		limiter:          limiter,
+	}
+}
+
+func (m emailModule) ApplyRoutes(r *mux.Router) {
+	handle(r, "/auth/verify_email", m.verifyEmail).Methods("POST")
+	handle(r, "/auth/verify_email/request", m.requestVerification).Methods("POST")
+	handle(r, "/auth/password_reset", m.resetPassword).Methods("POST")
+	handle(r, "/auth/password_reset/request", m.requestPasswordReset).Methods("POST")
+}
+
+func (m *emailModule) createToken(user *core.User, purpose string, lifetime time.Duration, now time.Time) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"sub":     user.ID,
+		"aud":     emailTokenAudience,
+		"purpose": purpose,
+		"jti":     jti,
+		"email":   user.Email,
+		"exp":     now.Add(lifetime).Unix(),
+		"iat":     now.Unix(),
+	}
+
+	// reset links die as soon as the password changes, whichever way
+	if purpose == purposeResetPassword {
+		claims["pwd"] = passwordFingerprint(user.Password)
+	}
+
+	return m.keys.Sign(claims)
+}
+
+func passwordFingerprint(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:8])
+}
+
+// consumeToken checks the token against the current state of its user and
+// marks it as used. Tokens of deleted users, or issued for an email or
+// password the user no longer has, are invalid.
+func (m *emailModule) consumeToken(tokenString, purpose string) (*core.User, error) {
+	claims, userID, err := parsePurposeToken(tokenString, m.keys, emailTokenAudience, purpose)
+	if err != nil {
+		return nil, errInvalidEmailToken
+	}
+
+	user, err := db.GetUserByID(m.db, int64(userID))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errInvalidEmailToken
+	case err != nil:
+		return nil, err
+	}
+
+	if claims["email"] != user.Email {
+		return nil, errInvalidEmailToken
+	}
+
+	if purpose == purposeResetPassword && claims["pwd"] != passwordFingerprint(user.Password) {
+		return nil, errInvalidEmailToken
+	}
+
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if jti == "" {
+		return nil, errInvalidEmailToken
+	}
+
+	if err := db.UseToken(m.db, jti, time.Unix(int64(exp), 0)); err != nil {
+		if db.IsDuplicateEntry(err) {
+			return nil, errTokenUsed
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// sendVerification emails the user a link to verify their address.
+func (m *emailModule) sendVerification(user *core.User, now time.Time) error {
+	token, err := m.createToken(user, purposeVerifyEmail, verifyEmailLifetime, now)
+	if err != nil {
+		return err
+	}
+
+	return m.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease confirm your email address to start offering rides:\n\n%s\n\nThe link expires in 24 hours.\n",
+			user.Name, link(m.verifyEmailURL, token)),
+	})
+}
+
+func (m *emailModule) sendPasswordReset(user *core.User, now time.Time) error {
+	token, err := m.createToken(user, purposeResetPassword, resetPasswordLifetime, now)
+	if err != nil {
+		return err
+	}
+
+	return m.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. If it was you, set a new password here:\n\n%s\n\nThe link expires in 1 hour. If you didn't ask for this, you can ignore this email.\n",
+			user.Name, link(m.resetPasswordURL, token)),
+	})
+}
+
+// link adds the token to the frontend page. Without a page the token is
+// sent on its own and has to be posted to the API by hand.
+func link(page, token string) string {
+	if page == "" {
+		return token
+	}
+
+	u, err := url.Parse(page)
+	if err != nil {
+		return token
+	}
+
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// mailAccount is the attempt counter for emails sent to an address. Every
+// email counts as an attempt so the endpoints can't be used to flood an inbox.
+func mailAccount(email string) string {
+	return "mail:" + email
+}
+
+func (m *emailModule) requestVerification(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	userAuth, err := authenticate(m.db, r, m.keys)
+	if err != nil {
+		log.WithError(err).Error("getting user auth")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := db.GetUserByID(m.db, int64(userAuth.UserID))
+	if err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	if user.EmailVerified() {
+		http.Error(w, "email already verified", http.StatusConflict)
+		return
+	}
+
+	account := mailAccount(user.Email)
+	if !m.limiter.Allow(w, r, log, account) {
+		return
+	}
+	m.limiter.Fail(r, log, account)
+
+	if err := m.sendVerification(user, time.Now()); err != nil {
+		log.WithError(err).Error("sending verification email")
+		http.Error(w, "sending email", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (m *emailModule) verifyEmail(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.EmailTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := m.consume(w, log, request.Token, purposeVerifyEmail)
+	if !ok {
+		return
+	}
+
+	if err := db.MarkEmailVerified(m.db, user.ID, user.Email); err != nil {
+		log.WithError(err).Error("verifying email")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestPasswordReset answers the same way whether or not the email belongs
+// to an account, so it can't be used to find out who is registered.
+func (m *emailModule) requestPasswordReset(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	email := core.NormalizeEmail(request.Email)
+	if err := core.ValidateEmail(email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	account := mailAccount(email)
+	if !m.limiter.Allow(w, r, log, account) {
+		return
+	}
+	m.limiter.Fail(r, log, account)
+
+	user, err := db.GetUserByEmail(m.db, email)
+	switch {
+	case err == sql.ErrNoRows:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case err != nil:
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	// sent in the background, waiting for the mail server would give away
+	// that the account exists
+	go func() {
+		if err := m.sendPasswordReset(user, time.Now()); err != nil {
+			log.WithError(err).Error("sending password reset email")
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (m *emailModule) resetPassword(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.EmailTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	if err := core.ValidatePassword(request.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := m.consume(w, log, request.Token, purposeResetPassword)
+	if !ok {
+		return
+	}
+
+	hash, err := HashPassword(request.Password)
+	if err != nil {
+		log.WithError(err).Error("hashing password")
+		http.Error(w, "hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.UpdateUserPassword(m.db, int64(user.ID), hash); err != nil {
+		log.WithError(err).Error("updating password")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	// whoever knew the old password is logged out
+	if err := db.RevokeSessionsByUserID(m.db, user.ID); err != nil {
+		log.WithError(err).Error("revoking sessions")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	// the link was delivered to the address, which proves the user owns it
+	if err := db.MarkEmailVerified(m.db, user.ID, user.Email); err != nil {
+		log.WithError(err).Error("verifying email")
+	}
+
+	// the account is unlocked under the same key that login counts failures in
+	m.limiter.Succeed(log, core.NormalizeEmail(user.Email))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *emailModule) consume(w http.ResponseWriter, log *logrus.Entry, token, purpose string) (*core.User, bool) {
+	user, err := m.consumeToken(token, purpose)
+	switch {
+	case err == errTokenUsed:
+		http.Error(w, errTokenUsed.Error(), http.StatusGone)
+		return nil, false
+	case err == errInvalidEmailToken:
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return nil, false
+	case err != nil:
+		log.WithError(err).Error("consuming token")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return nil, false
+	}
+
+	return user, true
+}
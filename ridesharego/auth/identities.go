@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"main/core"
+	"main/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	linkStatePurpose  = "link"
+	linkStateLifetime = 10 * time.Minute
+)
+
+// GetIdentities, LinkIdentity and UnlinkIdentity are served by the API
+// router, which authenticates the caller.
+func (m *oauthModule) GetIdentities(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, ok := authorizeUser(w, r, core.PermUserReadAny)
+	if !ok {
+		return
+	}
+
+	user, err := db.GetUserByID(d, int64(userID))
+	if err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	records, err := db.GetUserAuthsByUserID(d, userID)
+	if err != nil {
+		log.WithError(err).Error("getting identities")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	identities := core.UserIdentities{
+		HasPassword: user.Password != "",
+		Identities:  []core.Identity{},
+	}
+	for _, record := range records {
+		identities.Identities = append(identities.Identities, core.Identity{
+			Service: record.Service,
+			Subject: record.Token,
+		})
+	}
+
+	respond(w, http.StatusOK, identities)
+}
+
+// LinkIdentity returns the provider URL that the frontend should send the
+// user to. The identity is linked when the provider redirects back to the
+// browser that holds the nonce cookie.
+func (m *oauthModule) LinkIdentity(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, ok := authorizeUser(w, r, core.PermUserUpdateAny)
+	if !ok {
+		return
+	}
+
+	provider, ok := m.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return
+	}
+
+	nonce, err := randomToken(16)
+	if err != nil {
+		log.WithError(err).Error("generating nonce")
+		http.Error(w, "generating nonce", http.StatusInternalServerError)
+		return
+	}
+
+	state, err := m.createLinkState(userID, provider.name, nonce)
+	if err != nil {
+		log.WithError(err).Error("creating state")
+		http.Error(w, "creating state", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := provider.authCodeURL(r.Context(), state, flowNonce(nonce))
+	if err != nil {
+		log.WithError(err).WithField("provider", provider.name).Error("building authorization URL")
+		http.Error(w, "provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	http.SetCookie(w, stateCookie(oauthLinkCookie, nonce, provider))
+	respond(w, http.StatusOK, core.AuthorizationURL{URL: u})
+}
+
+func (m *oauthModule) UnlinkIdentity(w http.ResponseWriter, r *http.Request, log *logrus.Entry, d *sql.DB) {
+	userID, ok := authorizeUser(w, r, core.PermUserUpdateAny)
+	if !ok {
+		return
+	}
+
+	service := mux.Vars(r)["provider"]
+
+	user, err := db.GetUserByID(d, int64(userID))
+	if err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	records, err := db.GetUserAuthsByUserID(d, userID)
+	if err != nil {
+		log.WithError(err).Error("getting identities")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	remaining := 0
+	found := false
+	for _, record := range records {
+		if record.Service == service {
+			found = true
+			continue
+		}
+		remaining++
+	}
+
+	if !found {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if remaining == 0 && user.Password == "" {
+		http.Error(w, "cannot remove the last login method", http.StatusConflict)
+		return
+	}
+
+	if err := db.DeleteUserAuth(d, userID, service); err != nil {
+		log.WithError(err).Error("deleting identity")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeUser checks that the caller is the user in the path or holds the
+// permission to act on any user.
+func authorizeUser(w http.ResponseWriter, r *http.Request, permission string) (int, bool) {
+	userAuth := r.Context().Value(core.CtxAuth).(*core.UserAuth)
+
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	if userID != userAuth.UserID && !userAuth.Can(permission) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return 0, false
+	}
+
+	return userID, true
+}
+
+func (m *oauthModule) link(userID int, service string, identity *externalIdentity) error {
+	existing, err := db.GetUserAuthByToken(m.db, identity.Subject, service)
+	switch {
+	case err == nil && existing.UserID == int64(userID):
+		return nil
+	case err == nil:
+		return errIdentityInUse
+	case err != sql.ErrNoRows:
+		return err
+	}
+
+	return db.CreateUserAuth(m.db, core.UserAuthRecord{
+		UserID:  int64(userID),
+		Service: service,
+		Token:   identity.Subject,
+	})
+}
+
+func (m *oauthModule) createLinkState(userID int, provider, nonce string) (string, error) {
+	now := time.Now()
+	return m.keys.Sign(jwt.MapClaims{
+		"sub":      userID,
+		"purpose":  linkStatePurpose,
+		"provider": provider,
+		"nonce":    nonce,
+		"iat":      now.Unix(),
+		"exp":      now.Add(linkStateLifetime).Unix(),
+	})
+}
+
+// parseLinkState reports whether the state belongs to a linking flow, and if
+// so which user started it and the nonce of their browser. Login states are
+// random and never contain dots.
+func (m *oauthModule) parseLinkState(state, provider string) (int, string, bool, error) {
+	if !strings.Contains(state, ".") {
+		return 0, "", false, nil
+	}
+
+	token, err := m.keys.Parse(state)
+	if err != nil {
+		return 0, "", true, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return 0, "", true, errors.New("invalid state")
+	}
+
+	if claims["purpose"] != linkStatePurpose || claims["provider"] != provider {
+		return 0, "", true, errors.New("invalid state")
+	}
+
+	userID, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, "", true, errors.New("invalid state")
+	}
+
+	nonce, ok := claims["nonce"].(string)
+	if !ok {
+		return 0, "", true, errors.New("invalid state")
+	}
+
+	return int(userID), nonce, true, nil
+}
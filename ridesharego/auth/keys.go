@@ -0,0 +1,389 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"main/core"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	minRSAKeyBits = 2048
+	jwksMaxAge    = 5 * time.Minute
+)
+
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	// private is nil for keys that only verify
+	private   crypto.Signer
+	public    crypto.PublicKey
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+func (k *signingKey) valid(now time.Time) bool {
+	return k.notAfter.IsZero() || k.notAfter.After(now)
+}
+
+func (k *signingKey) canSign(now time.Time) bool {
+	return k.private != nil && !k.notBefore.After(now) && k.valid(now)
+}
+
+// Keyring holds the keys that sign and verify the tokens RideShare issues.
+// Tokens are signed with the newest active key and carry its ID in the kid
+// header, older keys keep verifying tokens until they expire, so keys can be
+// rotated by adding a key with a later not_before and retiring the old one
+// with not_after.
+type Keyring struct {
+	mu        sync.RWMutex
+	keys      map[string]*signingKey
+	ephemeral *signingKey
+	log       *logrus.Entry
+}
+
+func NewKeyring(configs []core.SigningKeyConfig, log *logrus.Entry) (*Keyring, error) {
+	k := &Keyring{log: log}
+	if err := k.Load(configs); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Load replaces the keys with the configured ones. The current keys stay in
+// use if any of the new ones can't be loaded. Without configured keys a
+// random key is generated, tokens signed with it stop working on restart.
+func (k *Keyring) Load(configs []core.SigningKeyConfig) error {
+	keys := map[string]*signingKey{}
+	for _, config := range configs {
+		key, err := loadSigningKey(config)
+		if err != nil {
+			return fmt.Errorf("signing key %q: %w", config.ID, err)
+		}
+
+		if _, ok := keys[key.id]; ok {
+			return fmt.Errorf("duplicate signing key %q", key.id)
+		}
+		keys[key.id] = key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(keys) == 0 {
+		if k.ephemeral == nil {
+			key, err := generateSigningKey()
+			if err != nil {
+				return err
+			}
+			k.ephemeral = key
+			k.log.WithField("kid", key.id).Warn("no signing keys configured, using a temporary key that is lost on restart")
+		}
+		keys[k.ephemeral.id] = k.ephemeral
+	}
+
+	k.keys = keys
+	return nil
+}
+
+// Watch loads the keys again every interval and on SIGHUP. Errors are
+// logged and the current keys stay in use.
+func (k *Keyring) Watch(interval time.Duration, load func() ([]core.SigningKeyConfig, error)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	go func() {
+		for {
+			select {
+			case <-tick:
+			case <-hangup:
+			}
+
+			configs, err := load()
+			if err == nil {
+				err = k.Load(configs)
+			}
+			if err != nil {
+				k.log.WithError(err).Error("reloading signing keys")
+				continue
+			}
+
+			k.log.Debug("signing keys reloaded")
+		}
+	}()
+}
+
+// Sign signs the claims with the newest key that is allowed to sign.
+func (k *Keyring) Sign(claims jwt.MapClaims) (string, error) {
+	key := k.signingKey(time.Now())
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+
+	return token.SignedString(key.private)
+}
+
+// Parse checks the signature of a token issued by RideShare, the claims are
+// left to the caller.
+func (k *Keyring) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		k.mu.RLock()
+		key, ok := k.keys[kid]
+		k.mu.RUnlock()
+
+		if !ok || !key.valid(time.Now()) {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		return key.public, nil
+	})
+}
+
+func (k *Keyring) signingKey(now time.Time) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var newest *signingKey
+	for _, key := range k.keys {
+		if !key.canSign(now) {
+			continue
+		}
+
+		if newest == nil || key.notBefore.After(newest.notBefore) ||
+			key.notBefore.Equal(newest.notBefore) && key.id > newest.id {
+			newest = key
+		}
+	}
+
+	return newest
+}
+
+// JWKS returns the public keys that tokens are or will soon be signed with.
+func (k *Keyring) JWKS() core.JWKS {
+	now := time.Now()
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	jwks := core.JWKS{Keys: []core.JWK{}}
+	for _, key := range k.keys {
+		if key.valid(now) {
+			jwks.Keys = append(jwks.Keys, key.jwk())
+		}
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+
+	return jwks
+}
+
+func (k *signingKey) jwk() core.JWK {
+	jwk := core.JWK{
+		Use: "sig",
+		Alg: k.method.Alg(),
+		Kid: k.id,
+	}
+
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+
+	return jwk
+}
+
+func (k *Keyring) ApplyRoutes(r *mux.Router) {
+	handle(r, "/.well-known/jwks.json", k.jwks).Methods("GET")
+}
+
+func (k *Keyring) jwks(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	respond(w, http.StatusOK, k.JWKS())
+}
+
+func loadSigningKey(config core.SigningKeyConfig) (*signingKey, error) {
+	if config.ID == "" {
+		return nil, errors.New("missing id")
+	}
+
+	key := &signingKey{id: config.ID}
+
+	switch {
+	case config.PrivateKey != "":
+		private, err := readPrivateKey(config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		key.private = private
+		key.public = private.Public()
+	case config.PublicKey != "":
+		public, err := readPublicKey(config.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		key.public = public
+	default:
+		return nil, errors.New("missing private_key or public_key")
+	}
+
+	var err error
+	if key.method, err = signingMethod(key.public); err != nil {
+		return nil, err
+	}
+
+	if config.NotBefore != "" {
+		if key.notBefore, err = time.Parse(time.RFC3339, config.NotBefore); err != nil {
+			return nil, fmt.Errorf("not_before: %w", err)
+		}
+	}
+
+	if config.NotAfter != "" {
+		if key.notAfter, err = time.Parse(time.RFC3339, config.NotAfter); err != nil {
+			return nil, fmt.Errorf("not_after: %w", err)
+		}
+
+		if !key.notAfter.After(key.notBefore) {
+			return nil, errors.New("not_after must be after not_before")
+		}
+	}
+
+	return key, nil
+}
+
+func generateSigningKey() (*signingKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signingKey{
+		id:      "ephemeral-" + id,
+		method:  jwt.SigningMethodEdDSA,
+		private: private,
+		public:  public,
+	}, nil
+}
+
+// signingMethod picks the algorithm from the key type, RS256 for RSA and
+// EdDSA for Ed25519.
+func signingMethod(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys need at least %d bits", minRSAKeyBits)
+		}
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+
+	return signer, nil
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return key, nil
+}
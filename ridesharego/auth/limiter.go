@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"main/core"
+	"main/db"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	attemptStoreMemory = "memory"
+	attemptStoreDB     = "db"
+
+	securityEventLockout = "lockout"
+
+	ipKeyPrefix      = "ip:"
+	accountKeyPrefix = "account:"
+
+	// the backoff stops doubling long before this, it only keeps the shift
+	// from overflowing
+	maxBackoffShift = 20
+)
+
+var (
+	defaultIPPolicy = core.AttemptPolicy{
+		FreeAttempts: 20,
+		MaxAttempts:  100,
+		BaseDelay:    core.Duration{Duration: time.Second},
+		MaxDelay:     core.Duration{Duration: time.Minute},
+		Window:       core.Duration{Duration: 15 * time.Minute},
+		Lockout:      core.Duration{Duration: 15 * time.Minute},
+	}
+
+	defaultAccountPolicy = core.AttemptPolicy{
+		FreeAttempts: 3,
+		MaxAttempts:  10,
+		BaseDelay:    core.Duration{Duration: time.Second},
+		MaxDelay:     core.Duration{Duration: 5 * time.Minute},
+		Window:       core.Duration{Duration: 15 * time.Minute},
+		Lockout:      core.Duration{Duration: 15 * time.Minute},
+	}
+)
+
+// AttemptStore keeps the failed attempt counters. Counters in memory only
+// protect a single instance, the DB store shares them between instances.
+type AttemptStore interface {
+	Get(key string) (*core.Attempts, error)
+	AddFailure(key string, now, windowStart time.Time) (*core.Attempts, error)
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+// Limiter slows down and eventually locks out clients and accounts with too
+// many failed authentication attempts.
+type Limiter struct {
+	db         *sql.DB
+	store      AttemptStore
+	trustProxy bool
+	ip         core.AttemptPolicy
+	account    core.AttemptPolicy
+}
+
+func NewLimiter(config core.BruteForceConfig, d *sql.DB) (*Limiter, error) {
+	l := &Limiter{
+		db:         d,
+		trustProxy: config.TrustProxy,
+		ip:         withDefaults(config.IP, defaultIPPolicy),
+		account:    withDefaults(config.Account, defaultAccountPolicy),
+	}
+
+	switch config.Store {
+	case "", attemptStoreMemory:
+		l.store = newMemoryAttemptStore()
+	case attemptStoreDB:
+		l.store = &dbAttemptStore{db: d}
+	default:
+		return nil, fmt.Errorf("brute_force: unknown store %q", config.Store)
+	}
+
+	return l, nil
+}
+
+func withDefaults(policy, defaults core.AttemptPolicy) core.AttemptPolicy {
+	if policy.FreeAttempts == 0 {
+		policy.FreeAttempts = defaults.FreeAttempts
+	}
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = defaults.MaxAttempts
+	}
+	if policy.BaseDelay.Duration == 0 {
+		policy.BaseDelay = defaults.BaseDelay
+	}
+	if policy.MaxDelay.Duration == 0 {
+		policy.MaxDelay = defaults.MaxDelay
+	}
+	if policy.Window.Duration == 0 {
+		policy.Window = defaults.Window
+	}
+	if policy.Lockout.Duration == 0 {
+		policy.Lockout = defaults.Lockout
+	}
+	return policy
+}
+
+// Allow checks the client IP and the account, if not empty, and rejects the
+// request with 429 while either of them has to wait.
+func (l *Limiter) Allow(w http.ResponseWriter, r *http.Request, log *logrus.Entry, account string) bool {
+	now := time.Now()
+
+	var wait time.Duration
+	for _, key := range l.keys(r, account) {
+		attempts, err := l.store.Get(key)
+		if err != nil {
+			log.WithError(err).Error("getting attempts")
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return false
+		}
+
+		if attempts == nil {
+			continue
+		}
+
+		if keyWait := backoff(l.policy(key), attempts, now); keyWait > wait {
+			wait = keyWait
+		}
+	}
+
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "too many attempts", http.StatusTooManyRequests)
+	return false
+}
+
+// Fail counts a failed attempt for the client IP and the account, and locks
+// them once they reach the maximum number of attempts.
+func (l *Limiter) Fail(r *http.Request, log *logrus.Entry, account string) {
+	now := time.Now()
+
+	for _, key := range l.keys(r, account) {
+		policy := l.policy(key)
+
+		attempts, err := l.store.AddFailure(key, now, now.Add(-policy.Window.Duration))
+		if err != nil {
+			log.WithError(err).Error("adding failed attempt")
+			continue
+		}
+
+		if attempts.Failures < policy.MaxAttempts || attempts.LockedUntil.After(now) {
+			continue
+		}
+
+		if err := l.store.Lock(key, now.Add(policy.Lockout.Duration)); err != nil {
+			log.WithError(err).Error("locking attempts")
+			continue
+		}
+
+		log.WithField("subject", key).Warn("too many failed attempts, locked out")
+
+		event := core.SecurityEvent{
+			Type:    securityEventLockout,
+			Subject: key,
+			IP:      l.clientIP(r),
+		}
+		if err := db.CreateSecurityEvent(l.db, event); err != nil {
+			log.WithError(err).Error("creating security event")
+		}
+	}
+}
+
+// Succeed clears the failures of the account. Failures of the IP are kept
+// so a client can't reset its counter with an account it controls.
+func (l *Limiter) Succeed(log *logrus.Entry, account string) {
+	if account == "" {
+		return
+	}
+
+	if err := l.store.Reset(accountKeyPrefix + account); err != nil {
+		log.WithError(err).Error("resetting attempts")
+	}
+}
+
+func (l *Limiter) keys(r *http.Request, account string) []string {
+	keys := []string{ipKeyPrefix + l.clientIP(r)}
+	if account != "" {
+		keys = append(keys, accountKeyPrefix+account)
+	}
+	return keys
+}
+
+func (l *Limiter) policy(key string) core.AttemptPolicy {
+	if strings.HasPrefix(key, ipKeyPrefix) {
+		return l.ip
+	}
+	return l.account
+}
+
+func (l *Limiter) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		// the last address is the one added by our proxy, earlier ones
+		// are sent by the client and can't be trusted
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// backoff returns how long the key has to wait before its next attempt. The
+// delay doubles with every failure after the free attempts.
+func backoff(policy core.AttemptPolicy, attempts *core.Attempts, now time.Time) time.Duration {
+	if attempts.LockedUntil.After(now) {
+		return attempts.LockedUntil.Sub(now)
+	}
+
+	if attempts.LastFailure.Before(now.Add(-policy.Window.Duration)) || attempts.Failures <= policy.FreeAttempts {
+		return 0
+	}
+
+	shift := attempts.Failures - policy.FreeAttempts - 1
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+
+	delay := policy.BaseDelay.Duration << shift
+	if delay > policy.MaxDelay.Duration {
+		delay = policy.MaxDelay.Duration
+	}
+
+	return attempts.LastFailure.Add(delay).Sub(now)
+}
+
+type memoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*core.Attempts
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{attempts: map[string]*core.Attempts{}}
+}
+
+func (s *memoryAttemptStore) Get(key string) (*core.Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return nil, nil
+	}
+
+	result := *attempts
+	return &result, nil
+}
+
+func (s *memoryAttemptStore) AddFailure(key string, now, windowStart time.Time) (*core.Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok || attempts.LastFailure.Before(windowStart) && !attempts.LockedUntil.After(now) {
+		attempts = &core.Attempts{Key: key}
+		s.attempts[key] = attempts
+		s.sweep(now, windowStart)
+	}
+
+	attempts.Failures++
+	attempts.LastFailure = now
+
+	result := *attempts
+	return &result, nil
+}
+
+// sweep drops counters that no longer matter so the map doesn't grow with
+// every client that ever failed once. It runs when a new counter is added.
+func (s *memoryAttemptStore) sweep(now, windowStart time.Time) {
+	for key, attempts := range s.attempts {
+		if attempts.LastFailure.Before(windowStart) && !attempts.LockedUntil.After(now) {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+func (s *memoryAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if attempts, ok := s.attempts[key]; ok {
+		attempts.LockedUntil = until
+	}
+	return nil
+}
+
+func (s *memoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+type dbAttemptStore struct {
+	db *sql.DB
+}
+
+func (s *dbAttemptStore) Get(key string) (*core.Attempts, error) {
+	attempts, err := db.GetAttempts(s.db, key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return attempts, err
+}
+
+func (s *dbAttemptStore) AddFailure(key string, now, windowStart time.Time) (*core.Attempts, error) {
+	if err := db.AddFailure(s.db, key, now, windowStart); err != nil {
+		return nil, err
+	}
+	return db.GetAttempts(s.db, key)
+}
+
+func (s *dbAttemptStore) Lock(key string, until time.Time) error {
+	return db.LockAttempts(s.db, key, until)
+}
+
+func (s *dbAttemptStore) Reset(key string) error {
+	return db.DeleteAttempts(s.db, key)
+}
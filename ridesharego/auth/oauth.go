@@ -0,0 +1,373 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"main/core"
+	"main/db"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// error codes passed to the frontend when the OAuth2 flow fails
+	loginErrorAccessDenied  = "access_denied"
+	loginErrorInvalidState  = "invalid_state"
+	loginErrorProvider      = "provider_error"
+	loginErrorMissingEmail  = "missing_email"
+	loginErrorAccountExists = "account_exists"
+	loginErrorIdentityInUse = "identity_in_use"
+
+	oauthStateCookie    = "oauth_state"
+	oauthLinkCookie     = "oauth_link"
+	oauthStateLifetime  = 10 * time.Minute
+	oauthCallbackPrefix = "/auth/"
+	oauthRequestTimeout = 10 * time.Second
+)
+
+var (
+	providerNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+	// names already taken by other routes under /auth/
+	reservedProviderNames = map[string]bool{
+		"login":          true,
+		"register":       true,
+		"refresh":        true,
+		"logout":         true,
+		"2fa":            true,
+		"verify_email":   true,
+		"password_reset": true,
+	}
+
+	errMissingEmail  = errors.New("provider did not return an email")
+	errAccountExists = errors.New("an account with this email already exists")
+	errIdentityInUse = errors.New("identity is linked to another account")
+)
+
+type oauthModule struct {
+	db          *sql.DB
+	providers   map[string]*oauthProvider
+	keys        *Keyring
+	frontendURL string
+	twoFactor   *twoFactorModule
+}
+
+func NewOAuthModule(providers []core.OAuthProviderConfig, db *sql.DB, keys *Keyring, frontendURL string, twoFactor *twoFactorModule) (*oauthModule, error) {
+	m := &oauthModule{
+		db:          db,
+		providers:   map[string]*oauthProvider{},
+		keys:        keys,
+		frontendURL: frontendURL,
+		twoFactor:   twoFactor,
+	}
+
+	for _, config := range providers {
+		if !providerNamePattern.MatchString(config.Name) || reservedProviderNames[config.Name] {
+			return nil, fmt.Errorf("invalid OAuth2 provider name %q", config.Name)
+		}
+
+		if _, ok := m.providers[config.Name]; ok {
+			return nil, fmt.Errorf("duplicate OAuth2 provider %q", config.Name)
+		}
+
+		if config.ClientID == "" {
+			return nil, fmt.Errorf("OAuth2 provider %q: missing client_id", config.Name)
+		}
+
+		if config.Issuer == "" && (config.AuthURL == "" || config.TokenURL == "") {
+			return nil, fmt.Errorf("OAuth2 provider %q: either issuer or auth_url and token_url are required", config.Name)
+		}
+
+		m.providers[config.Name] = newOAuthProvider(config)
+	}
+
+	return m, nil
+}
+
+func (m oauthModule) ApplyRoutes(r *mux.Router) {
+	for name, provider := range m.providers {
+		handle(r, "/auth/"+name, m.authorize(provider)).Methods("GET")
+		handle(r, "/auth/"+name+"/callback", m.callback(provider)).Methods("GET")
+	}
+}
+
+func (m *oauthModule) authorize(provider *oauthProvider) routeHandler {
+	return func(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+		ctx, cancel := context.WithTimeout(r.Context(), oauthRequestTimeout)
+		defer cancel()
+
+		state, err := randomToken(32)
+		if err != nil {
+			log.WithError(err).Error("generating state")
+			http.Error(w, "generating state", http.StatusInternalServerError)
+			return
+		}
+
+		u, err := provider.authCodeURL(ctx, state, flowNonce(state))
+		if err != nil {
+			log.WithError(err).WithField("provider", provider.name).Error("building authorization URL")
+			m.loginFailed(w, r, loginErrorProvider, http.StatusBadGateway)
+			return
+		}
+
+		// the state is bound to the browser that started the flow, so a callback
+		// can't be replayed into someone else's session
+		http.SetCookie(w, stateCookie(oauthStateCookie, state, provider))
+
+		http.Redirect(w, r, u, http.StatusFound)
+	}
+}
+
+func (m *oauthModule) callback(provider *oauthProvider) routeHandler {
+	return func(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+		log = log.WithField("provider", provider.name)
+
+		// linking flows are started through the API, their state is a signed
+		// token whose nonce is bound to the browser instead
+		linkUserID, linkNonce, linking, err := m.parseLinkState(r.FormValue("state"), provider.name)
+		cookie, secret := oauthStateCookie, r.FormValue("state")
+		if linking {
+			cookie, secret = oauthLinkCookie, linkNonce
+		}
+		if err == nil {
+			err = verifyState(w, r, cookie, secret)
+		}
+		if err != nil {
+			log.WithError(err).Error("verifying state")
+			m.loginFailed(w, r, loginErrorInvalidState, http.StatusBadRequest)
+			return
+		}
+
+		if providerError := r.FormValue("error"); providerError != "" {
+			log.WithField("error", providerError).Warn("login was not completed")
+			m.loginFailed(w, r, loginErrorAccessDenied, http.StatusUnauthorized)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), oauthRequestTimeout)
+		defer cancel()
+
+		identity, err := provider.identity(ctx, r.FormValue("code"), flowNonce(secret))
+		if err != nil {
+			log.WithError(err).Error("getting identity")
+			m.loginFailed(w, r, loginErrorProvider, http.StatusBadGateway)
+			return
+		}
+
+		if linking {
+			err := m.link(linkUserID, provider.name, identity)
+			switch {
+			case err == errIdentityInUse:
+				m.loginFailed(w, r, loginErrorIdentityInUse, http.StatusConflict)
+			case err != nil:
+				log.WithError(err).Error("linking identity")
+				m.loginFailed(w, r, loginErrorProvider, http.StatusInternalServerError)
+			default:
+				m.redirectToFrontend(w, r, "linked", provider.name, http.StatusOK)
+			}
+			return
+		}
+
+		user, err := m.resolveUser(provider.name, identity)
+		switch {
+		case err == errMissingEmail:
+			m.loginFailed(w, r, loginErrorMissingEmail, http.StatusBadRequest)
+			return
+		case err == errAccountExists:
+			m.loginFailed(w, r, loginErrorAccountExists, http.StatusConflict)
+			return
+		case err != nil:
+			log.WithError(err).Error("resolving user")
+			m.loginFailed(w, r, loginErrorProvider, http.StatusInternalServerError)
+			return
+		}
+
+		challenge, err := m.twoFactor.challenge(user, time.Now())
+		if err != nil {
+			log.WithError(err).Error("checking 2FA")
+			m.loginFailed(w, r, loginErrorProvider, http.StatusInternalServerError)
+			return
+		}
+
+		if challenge != nil {
+			m.challengeRequired(w, r, challenge)
+			return
+		}
+
+		token, err := IssueTokens(m.db, user, time.Now(), m.keys)
+		if err != nil {
+			log.WithError(err).Error("issuing tokens")
+			m.loginFailed(w, r, loginErrorProvider, http.StatusInternalServerError)
+			return
+		}
+
+		m.loginSucceeded(w, r, token)
+	}
+}
+
+// resolveUser finds the user linked to the external identity. On the first
+// login the identity is linked to the account with the same email if both
+// the provider and the account verified it, otherwise a new account is
+// created.
+func (m *oauthModule) resolveUser(service string, identity *externalIdentity) (*core.User, error) {
+	var userID int64
+	userAuthRecord, err := db.GetUserAuthByToken(m.db, identity.Subject, service)
+	switch {
+	case err == nil:
+		userID = userAuthRecord.UserID
+	case err == sql.ErrNoRows:
+		if identity.Email == "" {
+			return nil, errMissingEmail
+		}
+
+		existingUser, err := db.GetUserByEmail(m.db, identity.Email)
+		switch {
+		case err == nil && identity.EmailVerified && existingUser.EmailVerified():
+			userID = int64(existingUser.ID)
+		case err == nil:
+			// an unverified email could belong to anyone, and an account
+			// registered with someone else's address would otherwise keep the
+			// password of whoever registered it. The owner has to log in and
+			// link the identity themselves.
+			return nil, errAccountExists
+		case err == sql.ErrNoRows:
+			userID, err = db.CreateUser(m.db, identity.ToUser())
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+
+		userAuth := core.UserAuthRecord{
+			UserID:  userID,
+			Service: service,
+			Token:   identity.Subject,
+		}
+
+		err = db.CreateUserAuth(m.db, userAuth)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	return db.GetUserByID(m.db, userID)
+}
+
+// loginSucceeded hands the tokens to the frontend in the URL fragment, which
+// browsers never send to servers or leak through the Referer header.
+func (m *oauthModule) loginSucceeded(w http.ResponseWriter, r *http.Request, token *core.AuthToken) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if m.frontendURL == "" {
+		respond(w, http.StatusOK, token)
+		return
+	}
+
+	fragment := url.Values{}
+	fragment.Set("token", token.Token)
+	fragment.Set("token_type", token.TokenType)
+	fragment.Set("expires_at", strconv.FormatInt(token.ExpiresAt, 10))
+	fragment.Set("refresh_token", token.RefreshToken)
+	fragment.Set("refresh_expires_at", strconv.FormatInt(token.RefreshExpiresAt, 10))
+
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, m.frontendURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// challengeRequired sends the MFA token to the frontend the same way as the
+// access token, the login is then completed through /auth/login/2fa.
+func (m *oauthModule) challengeRequired(w http.ResponseWriter, r *http.Request, challenge *core.MFAChallenge) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if m.frontendURL == "" {
+		respond(w, http.StatusOK, challenge)
+		return
+	}
+
+	fragment := url.Values{}
+	fragment.Set("mfa_required", strconv.FormatBool(challenge.MFARequired))
+	fragment.Set("mfa_setup_required", strconv.FormatBool(challenge.MFASetupRequired))
+	fragment.Set("mfa_token", challenge.MFAToken)
+	fragment.Set("expires_at", strconv.FormatInt(challenge.ExpiresAt, 10))
+
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, m.frontendURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+func (m *oauthModule) loginFailed(w http.ResponseWriter, r *http.Request, code string, status int) {
+	m.redirectToFrontend(w, r, "error", code, status)
+}
+
+func (m *oauthModule) redirectToFrontend(w http.ResponseWriter, r *http.Request, key, value string, status int) {
+	if m.frontendURL == "" {
+		http.Error(w, value, status)
+		return
+	}
+
+	u, err := url.Parse(m.frontendURL)
+	if err != nil {
+		http.Error(w, value, status)
+		return
+	}
+
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func stateCookie(name, value string, provider *oauthProvider) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     oauthCallbackPrefix,
+		MaxAge:   int(oauthStateLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(provider.config.CallbackURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// flowNonce is the ID token nonce of the flow whose browser holds the secret
+// in its state cookie. It is hashed so the cookie value never reaches the
+// provider.
+func flowNonce(secret string) string {
+	return hashToken(secret)
+}
+
+// verifyState checks that the browser holds the cookie with the expected
+// value, which is the state itself or the nonce of a link state.
+func verifyState(w http.ResponseWriter, r *http.Request, name, expected string) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	// the state is single use
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     oauthCallbackPrefix,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(expected)) != 1 {
+		return errors.New("state mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"main/core"
+	"main/db"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	errInvalidCredentials = "invalid email or password"
+	passwordHashCost      = 12
+)
+
+// dummyHash is compared against when the user doesn't exist so that
+// failed logins take the same time whether or not the email is known.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("rideshare"), passwordHashCost)
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether password matches the stored value and whether
+// the stored value is a legacy plaintext password that should be rehashed.
+func checkPassword(stored, password string) (bool, bool) {
+	if stored == "" {
+		return false, false
+	}
+
+	if _, err := bcrypt.Cost([]byte(stored)); err != nil {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+}
+
+type passwordAuthModule struct {
+	db        *sql.DB
+	keys      *Keyring
+	twoFactor *twoFactorModule
+	email     *emailModule
+	limiter   *Limiter
+}
+
+func NewPasswordAuthModule(db *sql.DB, keys *Keyring, twoFactor *twoFactorModule, email *emailModule, limiter *Limiter) *passwordAuthModule {
+	return &passwordAuthModule{
+		db:        db,
+		keys:      keys,
+		twoFactor: twoFactor,
+		email:     email,
+		limiter:   limiter,
+	}
+}
+
+func (m passwordAuthModule) ApplyRoutes(r *mux.Router) {
+	handle(r, "/auth/login", m.login).Methods("POST")
+	handle(r, "/auth/register", m.register).Methods("POST")
+}
+
+func (m *passwordAuthModule) login(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var credentials core.Credentials
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	if err := credentials.Validate(); err != nil {
+		http.Error(w, errInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
+
+	// unknown emails are counted too, so probing for accounts is slowed down
+	// the same way as guessing passwords
+	account := core.NormalizeEmail(credentials.Email)
+	if !m.limiter.Allow(w, r, log, account) {
+		return
+	}
+
+	user, err := db.GetUserByEmail(m.db, account)
+	switch {
+	case err == sql.ErrNoRows:
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(credentials.Password))
+		m.limiter.Fail(r, log, account)
+		http.Error(w, errInvalidCredentials, http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	// users created through OAuth2 have no password and can't log in this way
+	ok, plaintext := checkPassword(user.Password, credentials.Password)
+	if !ok {
+		m.limiter.Fail(r, log, account)
+		http.Error(w, errInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
+	m.limiter.Succeed(log, account)
+
+	if plaintext {
+		if err := m.upgradePassword(user.ID, credentials.Password); err != nil {
+			log.WithError(err).WithField("user_id", user.ID).Error("upgrading plaintext password")
+		}
+	}
+
+	challenge, err := m.twoFactor.challenge(user, time.Now())
+	if err != nil {
+		log.WithError(err).Error("checking 2FA")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	if challenge != nil {
+		respond(w, http.StatusOK, challenge)
+		return
+	}
+
+	token, err := IssueTokens(m.db, user, time.Now(), m.keys)
+	if err != nil {
+		log.WithError(err).Error("creating token")
+		http.Error(w, "creating token", http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, token)
+}
+
+func (m *passwordAuthModule) upgradePassword(userID int, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return db.UpdateUserPassword(m.db, int64(userID), hash)
+}
+
+func (m *passwordAuthModule) register(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var user core.User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	// self-registered accounts never get elevated roles or preset settings
+	user.Name = strings.TrimSpace(user.Name)
+	user.Email = core.NormalizeEmail(user.Email)
+	user.Role = core.RoleUser
+	user.Settings = nil
+
+	if err := user.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("validating user: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if err := core.ValidatePassword(user.Password); err != nil {
+		http.Error(w, fmt.Sprintf("validating user: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.GetUserByEmail(m.db, user.Email)
+	switch {
+	case err == nil:
+		http.Error(w, "email already registered", http.StatusConflict)
+		return
+	case err != sql.ErrNoRows:
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	hash, err := HashPassword(user.Password)
+	if err != nil {
+		log.WithError(err).Error("hashing password")
+		http.Error(w, "hashing password", http.StatusInternalServerError)
+		return
+	}
+	user.Password = hash
+
+	id, err := db.CreateUser(m.db, user)
+	if err != nil {
+		log.WithError(err).Error("creating user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+	user.ID = int(id)
+
+	// the account works without a verified email, the user can ask for a
+	// new link if this one gets lost
+	if err := m.email.sendVerification(&user, time.Now()); err != nil {
+		log.WithError(err).Error("sending verification email")
+	}
+
+	token, err := IssueTokens(m.db, &user, time.Now(), m.keys)
+	if err != nil {
+		log.WithError(err).Error("creating token")
+		http.Error(w, "creating token", http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusCreated, token)
+}
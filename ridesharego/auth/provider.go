@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/core"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+)
+
+var defaultClaims = core.ClaimMapping{
+	Subject:       "sub",
+	Email:         "email",
+	EmailVerified: "email_verified",
+	Name:          "name",
+}
+
+// issuerAliases lists other values some providers put in the iss claim.
+var issuerAliases = map[string][]string{
+	googleIssuer: {"accounts.google.com"},
+}
+
+type externalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+func (i *externalIdentity) ToUser() core.User {
+	user := core.User{
+		Name:  i.Name,
+		Email: i.Email,
+	}
+
+	if i.EmailVerified {
+		verifiedAt := time.Now().UTC().Format(time.DateTime)
+		user.EmailVerifiedAt = &verifiedAt
+	}
+
+	return user
+}
+
+type openIDConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oauthProvider is a configured OAuth2 or OpenID Connect login provider.
+// Endpoints that aren't configured are discovered from the issuer the first
+// time they're needed, so a provider being down doesn't stop the server.
+type oauthProvider struct {
+	name    string
+	config  core.OAuthProviderConfig
+	claims  core.ClaimMapping
+	issuers []string
+	client  *http.Client
+
+	mu          sync.Mutex
+	oauth2      *oauth2.Config
+	userInfoURL string
+	jwks        *jwksCache
+}
+
+func newOAuthProvider(config core.OAuthProviderConfig) *oauthProvider {
+	claims := config.Claims
+	if claims.Subject == "" {
+		claims.Subject = defaultClaims.Subject
+	}
+	if claims.Email == "" {
+		claims.Email = defaultClaims.Email
+	}
+	if claims.EmailVerified == "" {
+		claims.EmailVerified = defaultClaims.EmailVerified
+	}
+	if claims.Name == "" {
+		claims.Name = defaultClaims.Name
+	}
+
+	var issuers []string
+	if config.Issuer != "" {
+		issuers = append([]string{config.Issuer}, issuerAliases[config.Issuer]...)
+	}
+
+	return &oauthProvider{
+		name:    config.Name,
+		config:  config,
+		claims:  claims,
+		issuers: issuers,
+		client:  &http.Client{Timeout: oauthRequestTimeout},
+	}
+}
+
+func (p *oauthProvider) endpoints(ctx context.Context) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth2 != nil {
+		return p.oauth2, nil
+	}
+
+	config := p.config
+	if config.AuthURL == "" || config.TokenURL == "" || (config.JWKSURL == "" && config.UserInfoURL == "") {
+		discovered, err := p.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.AuthURL == "" {
+			config.AuthURL = discovered.AuthorizationEndpoint
+		}
+		if config.TokenURL == "" {
+			config.TokenURL = discovered.TokenEndpoint
+		}
+		if config.UserInfoURL == "" {
+			config.UserInfoURL = discovered.UserInfoEndpoint
+		}
+		if config.JWKSURL == "" {
+			config.JWKSURL = discovered.JWKSURI
+		}
+	}
+
+	if config.JWKSURL != "" {
+		p.jwks = newJWKSCache(config.JWKSURL)
+	}
+	p.userInfoURL = config.UserInfoURL
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	p.oauth2 = &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		RedirectURL:  config.CallbackURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  config.AuthURL,
+			TokenURL: config.TokenURL,
+		},
+	}
+
+	return p.oauth2, nil
+}
+
+func (p *oauthProvider) discover(ctx context.Context) (*openIDConfiguration, error) {
+	if p.config.Issuer == "" {
+		return nil, errors.New("missing issuer")
+	}
+
+	u := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: unexpected status %d", resp.StatusCode)
+	}
+
+	var discovered openIDConfiguration
+	if err := json.NewDecoder(resp.Body).Decode(&discovered); err != nil {
+		return nil, err
+	}
+
+	if discovered.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", discovered.Issuer, p.config.Issuer)
+	}
+
+	return &discovered, nil
+}
+
+// authCodeURL sends the nonce along, providers put it in the ID token they
+// issue for the request.
+func (p *oauthProvider) authCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return config.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+// identity exchanges the authorization code and reads the user's identity
+// from the verified ID token, or from the userinfo endpoint for plain
+// OAuth2 providers that don't issue one. The ID token has to carry the nonce
+// of the flow, so one issued for another flow can't be replayed.
+func (p *oauthProvider) identity(ctx context.Context, code, nonce string) (*externalIdentity, error) {
+	config, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	idToken, _ := token.Extra("id_token").(string)
+	switch {
+	case idToken != "" && p.jwks != nil:
+		claims, err = p.verifyIDToken(idToken, nonce)
+	case p.userInfoURL != "":
+		claims, err = p.userInfo(ctx, config, token)
+	default:
+		err = errors.New("provider returned neither a verifiable ID token nor a userinfo endpoint")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &externalIdentity{
+		Subject:       claimString(claims, p.claims.Subject),
+		Email:         strings.ToLower(claimString(claims, p.claims.Email)),
+		EmailVerified: claimBool(claims, p.claims.EmailVerified),
+		Name:          claimString(claims, p.claims.Name),
+	}
+
+	if identity.Subject == "" {
+		return nil, errors.New("missing subject")
+	}
+
+	return identity, nil
+}
+
+func (p *oauthProvider) verifyIDToken(idToken, nonce string) (map[string]any, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return p.jwks.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid claims")
+	}
+
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, errors.New("invalid audience")
+	}
+
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token expired")
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, errors.New("invalid nonce")
+	}
+
+	if len(p.issuers) > 0 {
+		validIssuer := false
+		for _, issuer := range p.issuers {
+			if claims.VerifyIssuer(issuer, true) {
+				validIssuer = true
+				break
+			}
+		}
+
+		if !validIssuer {
+			return nil, errors.New("invalid issuer")
+		}
+	}
+
+	return claims, nil
+}
+
+func (p *oauthProvider) userInfo(ctx context.Context, config *oauth2.Config, token *oauth2.Token) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "RideShare-Go")
+
+	resp, err := config.Client(ctx, token).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo: unexpected status %d", resp.StatusCode)
+	}
+
+	var claims map[string]any
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func claimString(claims map[string]any, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+func claimBool(claims map[string]any, name string) bool {
+	switch v := claims[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
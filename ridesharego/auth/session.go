@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"main/core"
+	"main/db"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const errInvalidRefreshToken = "invalid refresh token"
+
+type sessionModule struct {
+	db      *sql.DB
+	keys    *Keyring
+	limiter *Limiter
+}
+
+func NewSessionModule(db *sql.DB, keys *Keyring, limiter *Limiter) *sessionModule {
+	return &sessionModule{
+		db:      db,
+		keys:    keys,
+		limiter: limiter,
+	}
+}
+
+func (m sessionModule) ApplyRoutes(r *mux.Router) {
+	handle(r, "/auth/refresh", m.refresh).Methods("POST")
+	handle(r, "/auth/logout", m.logout).Methods("POST")
+	handle(r, "/auth/logout/all", m.logoutAll).Methods("POST")
+}
+
+func (m *sessionModule) refresh(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	if request.RefreshToken == "" {
+		http.Error(w, "missing refresh_token", http.StatusBadRequest)
+		return
+	}
+
+	if !m.limiter.Allow(w, r, log, "") {
+		return
+	}
+
+	now := time.Now()
+	oldHash := hashToken(request.RefreshToken)
+
+	session, err := db.GetSessionByRefreshTokenHash(m.db, oldHash)
+	switch {
+	case err == sql.ErrNoRows:
+		m.limiter.Fail(r, log, "")
+		http.Error(w, errInvalidRefreshToken, http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.WithError(err).Error("getting session")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	if !session.Active(now) {
+		http.Error(w, errInvalidRefreshToken, http.StatusUnauthorized)
+		return
+	}
+
+	// the role might have changed since the session started
+	user, err := db.GetUserByID(m.db, int64(session.UserID))
+	if err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		log.WithError(err).Error("generating refresh token")
+		http.Error(w, "generating refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	refreshExpiresAt := now.Add(refreshTokenDuration)
+	err = db.RotateSessionRefreshToken(m.db, session.ID, oldHash, hashToken(refreshToken), refreshExpiresAt.UTC().Format(time.DateTime))
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, errInvalidRefreshToken, http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.WithError(err).Error("rotating refresh token")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	token, err := CreateToken(user, session.ID, now, m.keys)
+	if err != nil {
+		log.WithError(err).Error("creating token")
+		http.Error(w, "creating token", http.StatusInternalServerError)
+		return
+	}
+	token.RefreshToken = refreshToken
+	token.RefreshExpiresAt = refreshExpiresAt.Unix()
+
+	respond(w, http.StatusOK, token)
+}
+
+// logout ends the session of the given refresh token, or of the bearer
+// token if no refresh token is sent.
+func (m *sessionModule) logout(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.RefreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.WithError(err).Error("decoding request")
+			http.Error(w, "decoding request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var sessionID string
+	if request.RefreshToken != "" {
+		session, err := db.GetSessionByRefreshTokenHash(m.db, hashToken(request.RefreshToken))
+		switch {
+		case err == sql.ErrNoRows:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case err != nil:
+			log.WithError(err).Error("getting session")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, error, status)
+			return
+		}
+		sessionID = session.ID
+	} else {
+		userAuth, err := authenticate(m.db, r, m.keys)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sessionID = userAuth.SessionID
+	}
+
+	if err := db.RevokeSession(m.db, sessionID); err != nil {
+		log.WithError(err).Error("revoking session")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *sessionModule) logoutAll(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	userAuth, err := authenticate(m.db, r, m.keys)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.RevokeSessionsByUserID(m.db, userAuth.UserID); err != nil {
+		log.WithError(err).Error("revoking sessions")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,537 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"main/core"
+	"main/db"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTOTPIssuer = "RideShare"
+	mfaTokenAudience  = "rideshare-mfa"
+	mfaTokenLifetime  = 5 * time.Minute
+	mfaPurposeLogin   = "login"
+	mfaPurposeSetup   = "setup"
+	recoveryCodeCount = 10
+	errInvalidCode    = "invalid code"
+	errInvalidMFA     = "invalid mfa_token"
+)
+
+// twoFactorModule adds a TOTP step to logins of users who enrolled, and
+// makes users holding one of the required roles enrol before they get tokens.
+type twoFactorModule struct {
+	db            *sql.DB
+	keys          *Keyring
+	issuer        string
+	requiredRoles map[string]bool
+	limiter       *Limiter
+}
+
+func NewTwoFactorModule(config core.TwoFactorConfig, db *sql.DB, keys *Keyring, limiter *Limiter) (*twoFactorModule, error) {
+	m := &twoFactorModule{
+		db:            db,
+		keys:          keys,
+		issuer:        config.Issuer,
+		requiredRoles: map[string]bool{},
+		limiter:       limiter,
+	}
+
+	if m.issuer == "" {
+		m.issuer = defaultTOTPIssuer
+	}
+
+	for _, role := range config.RequiredRoles {
+		if !core.ValidRole(role) {
+			return nil, fmt.Errorf("two_factor: unknown role %q", role)
+		}
+		m.requiredRoles[role] = true
+	}
+
+	return m, nil
+}
+
+func (m twoFactorModule) ApplyRoutes(r *mux.Router) {
+	handle(r, "/auth/login/2fa", m.login).Methods("POST")
+	handle(r, "/auth/2fa", m.status).Methods("GET")
+	handle(r, "/auth/2fa/setup", m.setup).Methods("POST")
+	handle(r, "/auth/2fa/confirm", m.confirm).Methods("POST")
+	handle(r, "/auth/2fa/disable", m.disable).Methods("POST")
+	handle(r, "/auth/2fa/recovery_codes", m.regenerateRecoveryCodes).Methods("POST")
+}
+
+// challenge returns the step the user has to complete before tokens are
+// issued, or nil if the first factor is enough.
+func (m *twoFactorModule) challenge(user *core.User, now time.Time) (*core.MFAChallenge, error) {
+	totp, err := db.GetUserTOTP(m.db, user.ID)
+	switch {
+	case err == nil && totp.Confirmed():
+		return m.newChallenge(user.ID, mfaPurposeLogin, now)
+	case err != nil && err != sql.ErrNoRows:
+		return nil, err
+	}
+
+	required, err := m.required(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !required {
+		return nil, nil
+	}
+
+	return m.newChallenge(user.ID, mfaPurposeSetup, now)
+}
+
+func (m *twoFactorModule) required(userID int) (bool, error) {
+	if len(m.requiredRoles) == 0 {
+		return false, nil
+	}
+
+	roles, err := db.GetUserRoles(m.db, userID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, role := range roles {
+		if m.requiredRoles[role] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *twoFactorModule) newChallenge(userID int, purpose string, now time.Time) (*core.MFAChallenge, error) {
+	expiresAt := now.Add(mfaTokenLifetime)
+	token, err := m.keys.Sign(jwt.MapClaims{
+		"sub":     userID,
+		"aud":     mfaTokenAudience,
+		"purpose": purpose,
+		"exp":     expiresAt.Unix(),
+		"iat":     now.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.MFAChallenge{
+		MFARequired:      true,
+		MFASetupRequired: purpose == mfaPurposeSetup,
+		MFAToken:         token,
+		ExpiresAt:        expiresAt.Unix(),
+	}, nil
+}
+
+// parseMFAToken returns the user the challenge was issued to.
+func (m *twoFactorModule) parseMFAToken(tokenString, purpose string) (int, error) {
+	_, userID, err := parsePurposeToken(tokenString, m.keys, mfaTokenAudience, purpose)
+	return userID, err
+}
+
+// verifyCode accepts either a current TOTP code or an unused recovery code.
+func (m *twoFactorModule) verifyCode(userID int, code string, now time.Time) (bool, error) {
+	totp, err := db.GetUserTOTP(m.db, userID)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	case !totp.Confirmed():
+		return false, nil
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(totp.Secret, code, now, totp.LastUsedStep); ok {
+		err := db.UseTOTPStep(m.db, userID, step)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	err = db.UseRecoveryCode(m.db, userID, hashToken(normalizeRecoveryCode(code)))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *twoFactorModule) login(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := m.parseMFAToken(request.MFAToken, mfaPurposeLogin)
+
+	var account string
+	if err == nil {
+		account = mfaAccount(userID)
+	}
+
+	if !m.limiter.Allow(w, r, log, account) {
+		return
+	}
+
+	if err != nil {
+		m.limiter.Fail(r, log, "")
+		http.Error(w, errInvalidMFA, http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := m.verifyCode(userID, request.Code, time.Now())
+	if err != nil {
+		log.WithError(err).Error("verifying code")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	if !ok {
+		m.limiter.Fail(r, log, account)
+		http.Error(w, errInvalidCode, http.StatusUnauthorized)
+		return
+	}
+	m.limiter.Succeed(log, account)
+
+	m.issueTokens(w, log, userID)
+}
+
+// mfaAccount is the attempt counter for second factor codes, kept apart from
+// the password counter which is keyed by email.
+func mfaAccount(userID int) string {
+	return fmt.Sprintf("mfa:%d", userID)
+}
+
+func (m *twoFactorModule) issueTokens(w http.ResponseWriter, log *logrus.Entry, userID int) {
+	user, err := db.GetUserByID(m.db, int64(userID))
+	if err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	token, err := IssueTokens(m.db, user, time.Now(), m.keys)
+	if err != nil {
+		log.WithError(err).Error("creating token")
+		http.Error(w, "creating token", http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, http.StatusOK, token)
+}
+
+func (m *twoFactorModule) status(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	userAuth, err := authenticate(m.db, r, m.keys)
+	if err != nil {
+		log.WithError(err).Error("getting user auth")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var status core.TwoFactorStatus
+
+	totp, err := db.GetUserTOTP(m.db, userAuth.UserID)
+	switch {
+	case err == nil:
+		status.Enabled = totp.Confirmed()
+	case err != sql.ErrNoRows:
+		log.WithError(err).Error("getting totp")
+		error, code := db.SqlErrorToHTTP(err)
+		http.Error(w, error, code)
+		return
+	}
+
+	if status.Required, err = m.required(userAuth.UserID); err != nil {
+		log.WithError(err).Error("getting user roles")
+		error, code := db.SqlErrorToHTTP(err)
+		http.Error(w, error, code)
+		return
+	}
+
+	if status.RecoveryCodesRemaining, err = db.CountRecoveryCodes(m.db, userAuth.UserID); err != nil {
+		log.WithError(err).Error("counting recovery codes")
+		error, code := db.SqlErrorToHTTP(err)
+		http.Error(w, error, code)
+		return
+	}
+
+	respond(w, http.StatusOK, status)
+}
+
+// enrollingUser returns the user setting up 2FA, who is either logged in or
+// holds the MFA token of a login that requires enrolment.
+func (m *twoFactorModule) enrollingUser(w http.ResponseWriter, r *http.Request, log *logrus.Entry, request *core.TwoFactorRequest) (int, bool) {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil && err != io.EOF {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return 0, false
+	}
+
+	if request.MFAToken != "" {
+		userID, err := m.parseMFAToken(request.MFAToken, mfaPurposeSetup)
+		if err != nil {
+			http.Error(w, errInvalidMFA, http.StatusUnauthorized)
+			return 0, false
+		}
+		return userID, true
+	}
+
+	userAuth, err := authenticate(m.db, r, m.keys)
+	if err != nil {
+		log.WithError(err).Error("getting user auth")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	return userAuth.UserID, true
+}
+
+func (m *twoFactorModule) setup(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.TwoFactorRequest
+	userID, ok := m.enrollingUser(w, r, log, &request)
+	if !ok {
+		return
+	}
+
+	existing, err := db.GetUserTOTP(m.db, userID)
+	switch {
+	case err == nil && existing.Confirmed():
+		http.Error(w, "2FA is already enabled", http.StatusConflict)
+		return
+	case err != nil && err != sql.ErrNoRows:
+		log.WithError(err).Error("getting totp")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	user, err := db.GetUserByID(m.db, int64(userID))
+	if err != nil {
+		log.WithError(err).Error("getting user")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.WithError(err).Error("generating totp secret")
+		http.Error(w, "generating totp secret", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.SaveUserTOTP(m.db, userID, secret); err != nil {
+		log.WithError(err).Error("saving totp")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, http.StatusOK, core.TwoFactorSetup{
+		Secret:          secret,
+		ProvisioningURI: provisioningURI(m.issuer, user.Email, secret),
+	})
+}
+
+func (m *twoFactorModule) confirm(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	var request core.TwoFactorRequest
+	userID, ok := m.enrollingUser(w, r, log, &request)
+	if !ok {
+		return
+	}
+
+	totp, err := db.GetUserTOTP(m.db, userID)
+	switch {
+	case err == sql.ErrNoRows:
+		http.Error(w, "2FA setup not started", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.WithError(err).Error("getting totp")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	case totp.Confirmed():
+		http.Error(w, "2FA is already enabled", http.StatusConflict)
+		return
+	}
+
+	account := mfaAccount(userID)
+	if !m.limiter.Allow(w, r, log, account) {
+		return
+	}
+
+	step, ok := verifyTOTP(totp.Secret, strings.TrimSpace(request.Code), time.Now(), totp.LastUsedStep)
+	if !ok {
+		m.limiter.Fail(r, log, account)
+		http.Error(w, errInvalidCode, http.StatusBadRequest)
+		return
+	}
+	m.limiter.Succeed(log, account)
+
+	if err := db.ConfirmUserTOTP(m.db, userID, step); err != nil {
+		log.WithError(err).Error("confirming totp")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	codes, err := m.newRecoveryCodes(userID)
+	if err != nil {
+		log.WithError(err).Error("creating recovery codes")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+	response := core.RecoveryCodes{RecoveryCodes: codes}
+
+	// users who had to enrol to log in get their tokens right away
+	if request.MFAToken != "" {
+		user, err := db.GetUserByID(m.db, int64(userID))
+		if err != nil {
+			log.WithError(err).Error("getting user")
+			error, status := db.SqlErrorToHTTP(err)
+			http.Error(w, error, status)
+			return
+		}
+
+		if response.Token, err = IssueTokens(m.db, user, time.Now(), m.keys); err != nil {
+			log.WithError(err).Error("creating token")
+			http.Error(w, "creating token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, http.StatusOK, response)
+}
+
+func (m *twoFactorModule) disable(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	userID, ok := m.authenticateWithCode(w, r, log)
+	if !ok {
+		return
+	}
+
+	required, err := m.required(userID)
+	if err != nil {
+		log.WithError(err).Error("getting user roles")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	if required {
+		http.Error(w, "2FA is required for your role", http.StatusForbidden)
+		return
+	}
+
+	if err := db.DeleteUserTOTP(m.db, userID); err != nil {
+		log.WithError(err).Error("deleting totp")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *twoFactorModule) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	userID, ok := m.authenticateWithCode(w, r, log)
+	if !ok {
+		return
+	}
+
+	codes, err := m.newRecoveryCodes(userID)
+	if err != nil {
+		log.WithError(err).Error("creating recovery codes")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, http.StatusOK, core.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// authenticateWithCode guards changes to an enabled 2FA setup, which need
+// a code on top of the access token.
+func (m *twoFactorModule) authenticateWithCode(w http.ResponseWriter, r *http.Request, log *logrus.Entry) (int, bool) {
+	userAuth, err := authenticate(m.db, r, m.keys)
+	if err != nil {
+		log.WithError(err).Error("getting user auth")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	var request core.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.WithError(err).Error("decoding request")
+		http.Error(w, "decoding request", http.StatusBadRequest)
+		return 0, false
+	}
+
+	account := mfaAccount(userAuth.UserID)
+	if !m.limiter.Allow(w, r, log, account) {
+		return 0, false
+	}
+
+	ok, err := m.verifyCode(userAuth.UserID, request.Code, time.Now())
+	if err != nil {
+		log.WithError(err).Error("verifying code")
+		error, status := db.SqlErrorToHTTP(err)
+		http.Error(w, error, status)
+		return 0, false
+	}
+
+	if !ok {
+		m.limiter.Fail(r, log, account)
+		http.Error(w, errInvalidCode, http.StatusForbidden)
+		return 0, false
+	}
+	m.limiter.Succeed(log, account)
+
+	return userAuth.UserID, true
+}
+
+// newRecoveryCodes replaces the recovery codes of the user. Only hashes are
+// stored, so the codes are shown once.
+func (m *twoFactorModule) newRecoveryCodes(userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = hashToken(code)
+	}
+
+	if err := db.ReplaceRecoveryCodes(m.db, userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
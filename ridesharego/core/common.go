@@ -7,12 +7,17 @@ import (
 type CtxKey string
 
 const (
-	RoleAdmin = "admin"
-	RoleUser  = "user"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleSupport   = "support"
+	RoleDriver    = "driver"
+	RoleUser      = "user"
 
-	CtxLog  CtxKey = "logger"
-	CtxAuth CtxKey = "auth"
-	CtxDB   CtxKey = "db"
+	CtxLog       CtxKey = "logger"
+	CtxAuth      CtxKey = "auth"
+	CtxDB        CtxKey = "db"
+	CtxGazetteer CtxKey = "gazetteer"
+	CtxMailer    CtxKey = "mailer"
 )
 
 func SetupLogging() *logrus.Entry {
@@ -4,8 +4,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
+// Duration reads durations such as "15m" from the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
 type DBConfig struct {
 	Host     string `json:"host"`
 	Port     string `json:"port"`
@@ -18,15 +39,138 @@ type GoogleAuthConfig struct {
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
 	CallbackURL  string `json:"callback_url"`
+	JWKSURL      string `json:"jwks_url"`
+}
+
+// OAuthProviderConfig configures an OpenID Connect or plain OAuth2 login
+// provider. Endpoints left empty are discovered from the issuer.
+type OAuthProviderConfig struct {
+	Name         string       `json:"name"`
+	Issuer       string       `json:"issuer"`
+	ClientID     string       `json:"client_id"`
+	ClientSecret string       `json:"client_secret"`
+	CallbackURL  string       `json:"callback_url"`
+	Scopes       []string     `json:"scopes"`
+	AuthURL      string       `json:"auth_url"`
+	TokenURL     string       `json:"token_url"`
+	UserInfoURL  string       `json:"userinfo_url"`
+	JWKSURL      string       `json:"jwks_url"`
+	Claims       ClaimMapping `json:"claims"`
+}
+
+// ClaimMapping names the ID token or userinfo claims that hold each user
+// field, for providers that don't use the standard OpenID Connect names.
+type ClaimMapping struct {
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified string `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+type TwoFactorConfig struct {
+	// Issuer is shown next to the account name in authenticator apps.
+	Issuer string `json:"issuer"`
+	// RequiredRoles lists the roles that can't log in without 2FA.
+	RequiredRoles []string `json:"required_roles"`
+}
+
+// AttemptPolicy limits failed authentication attempts for one client IP or
+// one account. Zero values are replaced by defaults.
+type AttemptPolicy struct {
+	// FreeAttempts is the number of failures allowed before backoff starts.
+	FreeAttempts int `json:"free_attempts"`
+	// MaxAttempts is the number of failures that locks the IP or account.
+	MaxAttempts int      `json:"max_attempts"`
+	BaseDelay   Duration `json:"base_delay"`
+	MaxDelay    Duration `json:"max_delay"`
+	// Failures older than Window are forgotten.
+	Window  Duration `json:"window"`
+	Lockout Duration `json:"lockout"`
+}
+
+type BruteForceConfig struct {
+	// Store is "memory" for a single instance or "db" to share attempt
+	// counters between instances.
+	Store string `json:"store"`
+	// TrustProxy takes the client IP from X-Forwarded-For, only enable it
+	// behind a reverse proxy that sets the header.
+	TrustProxy bool          `json:"trust_proxy"`
+	IP         AttemptPolicy `json:"ip"`
+	Account    AttemptPolicy `json:"account"`
+}
+
+// SigningKeyConfig is a PEM key used for the tokens RideShare issues. RSA
+// keys sign with RS256 and Ed25519 keys with EdDSA.
+type SigningKeyConfig struct {
+	// ID is sent as the kid header and in the JWKS.
+	ID string `json:"id"`
+	// PrivateKey is the path of the private key. Keys with only a PublicKey
+	// verify tokens but never sign them.
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+	// NotBefore is when the key starts signing, in RFC 3339. Keys are
+	// published before that so other services already have them.
+	NotBefore string `json:"not_before"`
+	// NotAfter is when tokens signed with the key stop being accepted.
+	NotAfter string `json:"not_after"`
+}
+
+type SigningConfig struct {
+	Keys []SigningKeyConfig `json:"keys"`
+	// ReloadInterval is how often the keys are read again from the config
+	// and key files, they are also read again on SIGHUP.
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type MailConfig struct {
+	// Driver is "smtp", or "file" and "log" for local development.
+	Driver string     `json:"driver"`
+	From   string     `json:"from"`
+	SMTP   SMTPConfig `json:"smtp"`
+	// Path is the file the "file" driver appends messages to.
+	Path string `json:"path"`
+}
+
+type GeocodingConfig struct {
+	// Gazetteer is the path of a GeoNames dump such as cities15000.txt from
+	// https://download.geonames.org/export/dump/. Without it city names are
+	// only cleaned up and rides aren't geocoded.
+	Gazetteer string `json:"gazetteer"`
+}
+
+type BookingConfig struct {
+	// ApprovalDeadline is how long before departure the booking requests
+	// the driver hasn't answered expire.
+	ApprovalDeadline Duration `json:"approval_deadline"`
+	// ExpiryInterval is how often expired requests are looked for.
+	ExpiryInterval Duration `json:"expiry_interval"`
 }
 
 type Config struct {
 	MySQL  DBConfig `json:"db"`
 	Server struct {
-		Port       string `json:"port"`
-		AuthSecret string `json:"auth_secret"`
+		Port        string `json:"port"`
+		FrontendURL string `json:"frontend_url"`
+		// pages of the frontend that the links in emails point to, the
+		// token is added as a query parameter
+		VerifyEmailURL   string `json:"verify_email_url"`
+		ResetPasswordURL string `json:"reset_password_url"`
 	} `json:"server"`
-	GoogleAuth GoogleAuthConfig `json:"google_auth"`
+	GoogleAuth     GoogleAuthConfig      `json:"google_auth"`
+	OAuthProviders []OAuthProviderConfig `json:"oauth_providers"`
+	TwoFactor      TwoFactorConfig       `json:"two_factor"`
+	BruteForce     BruteForceConfig      `json:"brute_force"`
+	Mail           MailConfig            `json:"mail"`
+	Signing        SigningConfig         `json:"signing"`
+	Geocoding      GeocodingConfig       `json:"geocoding"`
+	Booking        BookingConfig         `json:"booking"`
 }
 
 func (c *DBConfig) DBConnectionString() string {
@@ -0,0 +1,21 @@
+package core
+
+import "encoding/xml"
+
+// PageRequest asks for one page of a list. Cursor is the next_cursor of the
+// previous page and Sort a field name, prefixed with "-" for descending order.
+// The sort can't change between the pages of a list.
+type PageRequest struct {
+	Limit  int
+	Cursor string
+	Sort   string
+}
+
+// Page is the envelope of every list response. NextCursor is empty on the
+// last page and Total counts the items of all pages.
+type Page[T any] struct {
+	XMLName    xml.Name `json:"-" xml:"page"`
+	Items      []T      `json:"items" xml:"items>item"`
+	NextCursor string   `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+	Total      int      `json:"total" xml:"total"`
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Permissions are named "<resource>:<action>[:any]". Actions on a user's own
+// resources are always allowed, the ":any" permissions extend them to
+// resources owned by other users.
+const (
+	PermUserReadAny   = "user:read:any"
+	PermUserCreate    = "user:create"
+	PermUserUpdateAny = "user:update:any"
+	PermUserDeleteAny = "user:delete:any"
+	PermRoleGrant     = "role:grant"
+
+	PermRideCreate    = "ride:create"
+	PermRideReadAny   = "ride:read:any"
+	PermRideUpdateAny = "ride:update:any"
+	PermRideDeleteAny = "ride:delete:any"
+
+	PermCarReadAny  = "car:read:any"
+	PermCarWriteAny = "car:write:any"
+
+	PermCatalogWrite = "catalog:write"
+
+	PermPassengerReadAny  = "passenger:read:any"
+	PermPassengerWriteAny = "passenger:write:any"
+
+	PermFeedbackReadAny  = "feedback:read:any"
+	PermFeedbackWriteAny = "feedback:write:any"
+
+	PermAPIKeyReadAny  = "api_key:read:any"
+	PermAPIKeyWriteAny = "api_key:write:any"
+)
+
+// API keys are limited to the scopes they were created with. ScopeRead and
+// ScopeWrite allow safe and unsafe requests, the other scopes are
+// permissions the key keeps from its user.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+var AllPermissions = []string{
+	PermUserReadAny,
+	PermUserCreate,
+	PermUserUpdateAny,
+	PermUserDeleteAny,
+	PermRoleGrant,
+	PermRideCreate,
+	PermRideReadAny,
+	PermRideUpdateAny,
+	PermRideDeleteAny,
+	PermCarReadAny,
+	PermCarWriteAny,
+	PermCatalogWrite,
+	PermPassengerReadAny,
+	PermPassengerWriteAny,
+	PermFeedbackReadAny,
+	PermFeedbackWriteAny,
+	PermAPIKeyReadAny,
+	PermAPIKeyWriteAny,
+}
+
+// RolePermissions is the policy mapping every role to the permissions it
+// grants. A user holds the union of the permissions of all their roles.
+var RolePermissions = map[string][]string{
+	RoleAdmin: AllPermissions,
+	RoleModerator: {
+		PermUserReadAny,
+		PermRideReadAny,
+		PermRideUpdateAny,
+		PermRideDeleteAny,
+		PermFeedbackReadAny,
+		PermFeedbackWriteAny,
+	},
+	RoleSupport: {
+		PermUserReadAny,
+		PermRideReadAny,
+		PermCarReadAny,
+		PermPassengerReadAny,
+		PermPassengerWriteAny,
+		PermFeedbackReadAny,
+		PermAPIKeyReadAny,
+	},
+	RoleDriver: {
+		PermRideCreate,
+	},
+	RoleUser: {},
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+func Roles() []Role {
+	roles := make([]Role, 0, len(RolePermissions))
+	for name, permissions := range RolePermissions {
+		roles = append(roles, Role{Name: name, Permissions: permissions})
+	}
+
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+
+	return roles
+}
+
+func NewUserAuth(userID int, sessionID string, roles []string) *UserAuth {
+	auth := &UserAuth{
+		UserID:      userID,
+		SessionID:   sessionID,
+		Roles:       roles,
+		Permissions: map[string]bool{},
+	}
+
+	for _, role := range roles {
+		for _, permission := range RolePermissions[role] {
+			auth.Permissions[permission] = true
+		}
+	}
+
+	return auth
+}
+
+// Can reports whether the user holds the permission. The empty permission
+// is held by every authenticated user.
+func (a *UserAuth) Can(permission string) bool {
+	return permission == "" || a.Permissions[permission]
+}
+
+// ValidScope reports whether an API key can be limited to the scope.
+func ValidScope(scope string) bool {
+	if scope == ScopeRead || scope == ScopeWrite {
+		return true
+	}
+
+	for _, permission := range AllPermissions {
+		if permission == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewAPIKeyAuth authenticates a request made with an API key. The key gets
+// the permissions its user currently holds that are also in its scopes.
+func NewAPIKeyAuth(key *APIKey, roles []string) *UserAuth {
+	auth := NewUserAuth(key.UserID, "", roles)
+	auth.APIKeyID = key.ID
+	auth.Scopes = map[string]bool{}
+
+	for _, scope := range key.Scopes {
+		auth.Scopes[scope] = true
+	}
+
+	for permission := range auth.Permissions {
+		if !auth.Scopes[permission] {
+			delete(auth.Permissions, permission)
+		}
+	}
+
+	return auth
+}
+
+// CanRequest reports whether the scopes allow the request method, write
+// includes read. Requests authenticated with a session have no scopes.
+func (a *UserAuth) CanRequest(method string) bool {
+	if a.APIKeyID == 0 || a.Scopes[ScopeWrite] {
+		return true
+	}
+
+	safe := method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+	return safe && a.Scopes[ScopeRead]
+}
+
+type UserRoles struct {
+	UserID      int      `json:"user_id"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+func (a *UserAuth) UserRoles() UserRoles {
+	permissions := make([]string, 0, len(a.Permissions))
+	for _, permission := range AllPermissions {
+		if a.Permissions[permission] {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	return UserRoles{
+		UserID:      a.UserID,
+		Roles:       a.Roles,
+		Permissions: permissions,
+	}
+}
@@ -3,12 +3,29 @@ package core
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
 	"time"
+	"unicode"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+
+	// a week, in minutes
+	maxCancellationCutoff = 7 * 24 * 60
 )
 
 type UserAuth struct {
-	Role   string
-	UserID int
+	UserID      int
+	SessionID   string
+	Roles       []string
+	Permissions map[string]bool
+	// APIKeyID and Scopes are only set for requests made with an API key
+	APIKeyID int
+	Scopes   map[string]bool
 }
 
 type Ride struct {
@@ -20,10 +37,113 @@ type Ride struct {
 	StartAddress string `json:"start_address"`
 	EndCity      string `json:"end_city"`
 	EndAddress   string `json:"end_address"`
-	CreatedAt    string `json:"created_at,omitempty"`
+	SeatsOffered int    `json:"seats_offered"`
+	// ManualApproval makes bookings wait for the driver to accept them
+	ManualApproval bool `json:"manual_approval"`
+	// CancellationCutoff is how many minutes before departure passengers
+	// can still cancel without it counting as a late cancellation, 0 for
+	// no cut-off
+	CancellationCutoff int `json:"cancellation_cutoff"`
+	// SeatsTaken and SeatsFree are counted from the pending and accepted
+	// bookings
+	SeatsTaken int    `json:"seats_taken"`
+	SeatsFree  int    `json:"seats_free"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	Status     string `json:"status"`
+	// when the ride entered each status, nil until it does
+	BoardingAt  *string `json:"boarding_at"`
+	StartedAt   *string `json:"started_at"`
+	CompletedAt *string `json:"completed_at"`
+	CancelledAt *string `json:"cancelled_at"`
+	// coordinates are optional, older rides only have the city
+	StartLocation *GeoPoint `json:"start_location,omitempty"`
+	EndLocation   *GeoPoint `json:"end_location,omitempty"`
+	// DetourDistance is only set in radius searches, it is the distance in
+	// meters from the searched start to the ride start plus the one from
+	// the ride end to the searched end
+	DetourDistance *float64 `json:"detour_distance,omitempty"`
+}
+
+const (
+	RideScheduled  = "scheduled"
+	RideBoarding   = "boarding"
+	RideInProgress = "in_progress"
+	RideCompleted  = "completed"
+	RideCancelled  = "cancelled"
+)
+
+// rideTransitions lists the statuses a ride can change to from each status.
+// Completed and cancelled rides are final.
+var rideTransitions = map[string][]string{
+	RideScheduled:  {RideBoarding, RideInProgress, RideCancelled},
+	RideBoarding:   {RideInProgress, RideCancelled},
+	RideInProgress: {RideCompleted},
+}
+
+func ValidRideStatus(status string) bool {
+	switch status {
+	case RideScheduled, RideBoarding, RideInProgress, RideCompleted, RideCancelled:
+		return true
+	}
+	return false
+}
+
+// CanTransition checks that the ride can change to the status.
+func (r *Ride) CanTransition(status string) error {
+	for _, next := range rideTransitions[r.Status] {
+		if next == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("ride is %s and can't become %s", r.Status, status)
 }
 
-func (r *Ride) Validate(car *Car) error {
+// LateCancellation reports whether a passenger cancelling at now is past
+// the cancellation cut-off of the ride.
+func (r *Ride) LateCancellation(now time.Time) (bool, error) {
+	if r.CancellationCutoff == 0 {
+		return false, nil
+	}
+
+	startTime, err := time.Parse("2006-01-02 15:04:05", r.StartDate)
+	if err != nil {
+		return false, err
+	}
+
+	cutoff := startTime.Add(-time.Duration(r.CancellationCutoff) * time.Minute)
+	return !now.Before(cutoff), nil
+}
+
+// GeoPoint is a WGS 84 coordinate in degrees.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func (p *GeoPoint) Validate() error {
+	if p.Lat < -90 || p.Lat > 90 {
+		return errors.New("latitude out of range")
+	}
+
+	if p.Lng < -180 || p.Lng > 180 {
+		return errors.New("longitude out of range")
+	}
+
+	return nil
+}
+
+// Place is a city of the gazetteer.
+type Place struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Country    string   `json:"country"`
+	Location   GeoPoint `json:"location"`
+	Population int      `json:"population"`
+}
+
+// Validate checks the ride, category is the one of the vehicle. Its
+// passenger count includes the driver.
+func (r *Ride) Validate(car *Car, category *CarCategory) error {
 	if r.OwnerID == 0 {
 		return errors.New("missing owner_user_id")
 	}
@@ -56,20 +176,178 @@ func (r *Ride) Validate(car *Car) error {
 		return errors.New("missing end_address")
 	}
 
+	if r.SeatsOffered < 1 {
+		return errors.New("missing seats_offered")
+	}
+
+	if r.CancellationCutoff < 0 || r.CancellationCutoff > maxCancellationCutoff {
+		return fmt.Errorf("cancellation_cutoff must be between 0 and %d minutes", maxCancellationCutoff)
+	}
+
+	if maxSeats := category.PassengerCount - 1; r.SeatsOffered > maxSeats {
+		return fmt.Errorf("vehicle has at most %d seats to offer", maxSeats)
+	}
+
+	if (r.StartLocation == nil) != (r.EndLocation == nil) {
+		return errors.New("start_location and end_location must be set together")
+	}
+
+	if r.StartLocation != nil {
+		if err := r.StartLocation.Validate(); err != nil {
+			return fmt.Errorf("start_location: %w", err)
+		}
+
+		if err := r.EndLocation.Validate(); err != nil {
+			return fmt.Errorf("end_location: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// RideFilter narrows down the ride search, zero values don't filter.
+// Cities match case-insensitively, addresses also match partially.
+type RideFilter struct {
+	StartCity    string
+	StartAddress string
+	EndCity      string
+	EndAddress   string
+	// DateFrom and DateTo bound the start date, both inclusive
+	DateFrom     string
+	DateTo       string
+	MinFreeSeats int
+	OwnerID      int
+	// Statuses the ride can be in, any if empty
+	Statuses []string
+	// StartNear and EndNear search rides starting and ending within the
+	// radius in meters. Rides without coordinates match by city instead,
+	// if one is searched.
+	StartNear   *GeoPoint
+	StartRadius float64
+	EndNear     *GeoPoint
+	EndRadius   float64
+}
+
+// PassengerFilter narrows down the bookings of a ride, zero values don't
+// filter.
+type PassengerFilter struct {
+	Statuses []string
+	// MinReliability leaves out passengers with a lower reliability score,
+	// passengers without trips yet are kept
+	MinReliability int
+}
+
 type User struct {
-	ID        int             `json:"id"`
-	Name      string          `json:"name"`
-	Email     string          `json:"email"`
-	Password  string          `json:"password"`
-	Role      string          `json:"role"`
-	Settings  json.RawMessage `json:"settings"`
-	CreatedAt string          `json:"created_at,omitempty"`
+	ID              int             `json:"id"`
+	Name            string          `json:"name"`
+	Email           string          `json:"email"`
+	Password        string          `json:"password" xml:"-"`
+	Role            string          `json:"role"`
+	Settings        json.RawMessage `json:"settings"`
+	EmailVerifiedAt *string         `json:"email_verified_at"`
+	CreatedAt       string          `json:"created_at,omitempty"`
+}
+
+// UserProfile is the view of a user shown to the account owner and admins.
+type UserProfile struct {
+	ID              int             `json:"id"`
+	Name            string          `json:"name"`
+	Email           string          `json:"email"`
+	Role            string          `json:"role"`
+	Settings        json.RawMessage `json:"settings"`
+	EmailVerifiedAt *string         `json:"email_verified_at"`
+	CreatedAt       string          `json:"created_at,omitempty"`
+}
+
+// PublicUserProfile is the view of a user shown to other riders.
+type PublicUserProfile struct {
+	ID          int         `json:"id"`
+	Name        string      `json:"name"`
+	Rating      float64     `json:"rating"`
+	RatingCount int         `json:"rating_count"`
+	Reliability Reliability `json:"reliability"`
+	MemberSince string      `json:"member_since"`
+}
+
+// Reliability sums up how a user keeps their bookings as a passenger.
+type Reliability struct {
+	// Trips counts the completed rides the user was booked on and the
+	// bookings they cancelled late
+	Trips             int `json:"trips"`
+	LateCancellations int `json:"late_cancellations"`
+	NoShows           int `json:"no_shows"`
+	// Score goes from 0 to 100, no-shows weigh twice as much as late
+	// cancellations. It is nil for users without trips.
+	Score *int `json:"score"`
+}
+
+const (
+	IncidentLateCancellation = "late_cancellation"
+	IncidentNoShow           = "no_show"
+)
+
+// Incident is a late cancellation or a no-show of a passenger.
+type Incident struct {
+	ID        int    `json:"id"`
+	RideID    int    `json:"ride_id"`
+	UserID    int    `json:"user_id"`
+	Kind      string `json:"kind"`
+	CreatedAt string `json:"created_at"`
+}
+
+type UserRating struct {
+	Average float64
+	Count   int
+}
+
+// MarshalJSON never lets the password hash leave the server, even if a
+// handler responds with the full user by mistake.
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.Profile())
+}
+
+func (u *User) Profile() UserProfile {
+	return UserProfile{
+		ID:              u.ID,
+		Name:            u.Name,
+		Email:           u.Email,
+		Role:            u.Role,
+		Settings:        u.Settings,
+		EmailVerifiedAt: u.EmailVerifiedAt,
+		CreatedAt:       u.CreatedAt,
+	}
+}
+
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+func (u *User) PublicProfile(rating UserRating, reliability Reliability) PublicUserProfile {
+	return PublicUserProfile{
+		ID:          u.ID,
+		Name:        u.Name,
+		Rating:      rating.Average,
+		RatingCount: rating.Count,
+		Reliability: reliability,
+		MemberSince: u.CreatedAt,
+	}
 }
 
 func (u *User) Validate() error {
+	if err := u.ValidateProfile(); err != nil {
+		return err
+	}
+
+	if u.Password == "" {
+		return errors.New("missing password")
+	}
+
+	return nil
+}
+
+// ValidateProfile checks the user without the password, which updates can
+// leave out.
+func (u *User) ValidateProfile() error {
 	if u.Name == "" {
 		return errors.New("missing name")
 	}
@@ -78,8 +356,49 @@ func (u *User) Validate() error {
 		return errors.New("missing email")
 	}
 
-	if u.Password == "" {
-		return errors.New("missing password")
+	if err := ValidateEmail(u.Email); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// NormalizeEmail is the form emails are stored and rate limited in.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func ValidateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return errors.New("invalid email")
+	}
+
+	return nil
+}
+
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("password must be at least 8 characters long")
+	}
+
+	// bcrypt only uses the first 72 bytes of the password
+	if len(password) > maxPasswordLength {
+		return errors.New("password must be at most 72 bytes long")
+	}
+
+	var hasLetter, hasDigit bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		}
+	}
+
+	if !hasLetter || !hasDigit {
+		return errors.New("password must contain both letters and digits")
 	}
 
 	return nil
@@ -174,16 +493,109 @@ func (cc *CarCategory) Validate() error {
 }
 
 type Passenger struct {
-	RideID      int    `json:"ride_id"`
-	PassengerID int    `json:"passenger_id"`
-	CreatedAt   string `json:"created_at"`
+	RideID      int `json:"ride_id"`
+	PassengerID int `json:"passenger_id"`
+	// Seats is the number of seats booked, for the passenger and the people
+	// they bring
+	Seats     int    `json:"seats"`
+	CreatedAt string `json:"created_at"`
+	Status    string `json:"status"`
+	// Reason is given by the driver when rejecting the booking
+	Reason    *string `json:"reason"`
+	DecidedAt *string `json:"decided_at"`
+}
+
+const (
+	PassengerPending  = "pending"
+	PassengerAccepted = "accepted"
+	PassengerRejected = "rejected"
+	PassengerExpired  = "expired"
+)
+
+func ValidPassengerStatus(status string) bool {
+	switch status {
+	case PassengerPending, PassengerAccepted, PassengerRejected, PassengerExpired:
+		return true
+	}
+	return false
+}
+
+// WaitlistEntry is a rider waiting for seats on a full ride. Riders get the
+// seats in the order they joined, as soon as enough are free for the first
+// one in line.
+type WaitlistEntry struct {
+	ID        int    `json:"id"`
+	RideID    int    `json:"ride_id"`
+	UserID    int    `json:"user_id"`
+	Seats     int    `json:"seats"`
+	CreatedAt string `json:"created_at"`
+	// Position is 1 for the rider who gets the next free seats
+	Position int `json:"position"`
+}
+
+// WaitlistPromotion is a ride and the bookings its waitlist got for seats
+// that were freed without a request, like by expired bookings.
+type WaitlistPromotion struct {
+	Ride     Ride
+	Promoted []Passenger
+}
+
+func (e *WaitlistEntry) Validate(ride *Ride, passengers []Passenger) error {
+	if ride.Status != RideScheduled {
+		return fmt.Errorf("ride is %s", ride.Status)
+	}
+
+	if ride.OwnerID == e.UserID {
+		return errors.New("owner cannot join the waitlist")
+	}
+
+	if e.Seats < 1 {
+		return errors.New("invalid seats")
+	}
+
+	if e.Seats > ride.SeatsOffered {
+		return fmt.Errorf("ride only offers %d seats", ride.SeatsOffered)
+	}
+
+	if e.Seats <= ride.SeatsFree {
+		return errors.New("seats are free, book them instead")
+	}
+
+	for _, passenger := range passengers {
+		if passenger.PassengerID != e.UserID {
+			continue
+		}
+
+		switch passenger.Status {
+		case PassengerPending, PassengerAccepted:
+			return errors.New("user is already a passenger")
+		case PassengerRejected:
+			return errors.New("booking was rejected")
+		}
+	}
+
+	return nil
+}
+
+// BookingDecision is sent by the driver accepting or rejecting a booking.
+type BookingDecision struct {
+	Reason string `json:"reason"`
 }
 
-func (p *Passenger) Validate(ride *Ride, passengers []Passenger, passengerCount int) error {
+func (p *Passenger) Validate(ride *Ride, passengers []Passenger) error {
 	if p.RideID == 0 {
 		return errors.New("missing ride_id")
 	}
 
+	switch ride.Status {
+	case RideScheduled:
+	case RideCancelled:
+		return errors.New("ride is cancelled")
+	default:
+		return errors.New("ride has already started")
+	}
+
+	// scheduled rides whose driver hasn't started them yet
 	startTime, err := time.Parse("2006-01-02 15:04:05", ride.StartDate)
 	if err != nil {
 		return err
@@ -193,14 +605,32 @@ func (p *Passenger) Validate(ride *Ride, passengers []Passenger, passengerCount
 		return errors.New("ride has already started")
 	}
 
+	// expired requests can be made again, rejected ones can't
 	for _, passenger := range passengers {
-		if passenger.PassengerID == p.PassengerID {
+		if passenger.PassengerID != p.PassengerID {
+			continue
+		}
+
+		switch passenger.Status {
+		case PassengerPending:
+			return errors.New("user already requested a seat")
+		case PassengerRejected:
+			return errors.New("booking was rejected")
+		case PassengerAccepted:
 			return errors.New("user is already a passenger")
 		}
 	}
 
-	if len(passengers) >= passengerCount {
-		return errors.New("ride is full")
+	if p.Seats < 1 {
+		return errors.New("invalid seats")
+	}
+
+	if ride.SeatsFree == 0 {
+		return errors.New("ride is full, join the waitlist instead")
+	}
+
+	if p.Seats > ride.SeatsFree {
+		return fmt.Errorf("only %d seats are free", ride.SeatsFree)
 	}
 
 	if p.PassengerID == 0 {
@@ -219,7 +649,7 @@ type Feedback struct {
 	CreatedAt string `json:"created_at"`
 }
 
-func (f *Feedback) Validate(ride *Ride, passengers []Passenger, role string) error {
+func (f *Feedback) Validate(ride *Ride, passengers []Passenger, canWriteAny bool) error {
 	if f.UserID == 0 {
 		return errors.New("missing user_id")
 	}
@@ -232,15 +662,19 @@ func (f *Feedback) Validate(ride *Ride, passengers []Passenger, role string) err
 		return errors.New("owner cannot leave feedback")
 	}
 
+	if ride.Status != RideCompleted {
+		return errors.New("ride is not completed")
+	}
+
 	passengerFound := false
 	for _, passenger := range passengers {
-		if passenger.PassengerID == f.UserID {
+		if passenger.PassengerID == f.UserID && passenger.Status == PassengerAccepted {
 			passengerFound = true
 			break
 		}
 	}
 
-	if !passengerFound && role != RoleAdmin {
+	if !passengerFound && !canWriteAny {
 		return errors.New("user is not a passenger")
 	}
 
@@ -260,3 +694,225 @@ type UserAuthRecord struct {
 	Service string `json:"service"`
 	Token   string `json:"token"`
 }
+
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (c *Credentials) Validate() error {
+	if c.Email == "" {
+		return errors.New("missing email")
+	}
+
+	if c.Password == "" {
+		return errors.New("missing password")
+	}
+
+	return nil
+}
+
+type AuthToken struct {
+	Token            string `json:"token"`
+	TokenType        string `json:"token_type"`
+	ExpiresAt        int64  `json:"expires_at"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	RefreshExpiresAt int64  `json:"refresh_expires_at,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// JWK is a public key in the JSON Web Key format, RSA keys set N and E and
+// Ed25519 keys set Crv and X.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type Session struct {
+	ID               string  `json:"id"`
+	UserID           int     `json:"user_id"`
+	RefreshTokenHash string  `json:"-"`
+	ExpiresAt        string  `json:"expires_at"`
+	RevokedAt        *string `json:"revoked_at"`
+	CreatedAt        string  `json:"created_at"`
+}
+
+func (s *Session) Active(now time.Time) bool {
+	if s.RevokedAt != nil {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.DateTime, s.ExpiresAt)
+	if err != nil {
+		return false
+	}
+
+	return expiresAt.After(now)
+}
+
+type APIKey struct {
+	ID         int      `json:"id"`
+	UserID     int      `json:"user_id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	KeyHash    string   `json:"-"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  *string  `json:"expires_at"`
+	LastUsedAt *string  `json:"last_used_at"`
+	RevokedAt  *string  `json:"revoked_at"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+func (k *APIKey) Active(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+
+	if k.ExpiresAt == nil {
+		return true
+	}
+
+	expiresAt, err := time.Parse(time.DateTime, *k.ExpiresAt)
+	if err != nil {
+		return false
+	}
+
+	return expiresAt.After(now)
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is optional, keys without it are valid until revoked
+	ExpiresAt *string `json:"expires_at"`
+}
+
+func (r *APIKeyRequest) Validate(now time.Time) error {
+	if r.Name == "" {
+		return errors.New("missing name")
+	}
+
+	if len(r.Scopes) == 0 {
+		return errors.New("missing scopes")
+	}
+
+	for _, scope := range r.Scopes {
+		if !ValidScope(scope) {
+			return fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+
+	if r.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.DateTime, *r.ExpiresAt)
+		if err != nil {
+			return errors.New("invalid expires_at")
+		}
+
+		if !expiresAt.After(now) {
+			return errors.New("expires_at is in the past")
+		}
+	}
+
+	return nil
+}
+
+// CreatedAPIKey is only returned when the key is created, the key can't be
+// read again afterwards.
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type Identity struct {
+	Service string `json:"service"`
+	Subject string `json:"subject"`
+}
+
+type UserIdentities struct {
+	HasPassword bool       `json:"has_password"`
+	Identities  []Identity `json:"identities"`
+}
+
+type AuthorizationURL struct {
+	URL string `json:"authorization_url"`
+}
+
+type TOTP struct {
+	UserID       int     `json:"user_id"`
+	Secret       string  `json:"-"`
+	ConfirmedAt  *string `json:"confirmed_at"`
+	LastUsedStep int64   `json:"-"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+func (t *TOTP) Confirmed() bool {
+	return t.ConfirmedAt != nil
+}
+
+type TwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	Required               bool `json:"required"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+type TwoFactorSetup struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type TwoFactorRequest struct {
+	MFAToken string `json:"mfa_token,omitempty"`
+	Code     string `json:"code"`
+}
+
+// MFAChallenge is returned by the first login step instead of tokens when
+// the user has to enter a code, or has to enrol first if 2FA is enforced.
+type MFAChallenge struct {
+	MFARequired      bool   `json:"mfa_required"`
+	MFASetupRequired bool   `json:"mfa_setup_required"`
+	MFAToken         string `json:"mfa_token"`
+	ExpiresAt        int64  `json:"expires_at"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string   `json:"recovery_codes"`
+	Token         *AuthToken `json:"token,omitempty"`
+}
+
+// Attempts counts the failed authentication attempts of an IP or account.
+type Attempts struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+type SecurityEvent struct {
+	ID        int    `json:"id"`
+	Type      string `json:"type"`
+	Subject   string `json:"subject"`
+	IP        string `json:"ip"`
+	CreatedAt string `json:"created_at"`
+}
+
+type EmailTokenRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password,omitempty"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"database/sql"
+	"main/core"
+	"strings"
+)
+
+func GetAPIKeyByHash(db *sql.DB, hash string) (*core.APIKey, error) {
+	row := db.QueryRow("SELECT * FROM api_key WHERE key_hash = ?", hash)
+	var scopes string
+	var k core.APIKey
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &scopes, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	return &k, nil
+}
+
+func GetAPIKeysByUserID(db *sql.DB, userID int, p core.PageRequest) (*core.Page[core.APIKey], error) {
+	id := sortField[core.APIKey]{"id", func(k core.APIKey) any { return k.ID }}
+	return listQuery[core.APIKey]{
+		selectFrom: "SELECT * FROM api_key",
+		conditions: []string{"user_id = ?"},
+		args:       []any{userID},
+		id:         id,
+		sorts: map[string]sortField[core.APIKey]{
+			"id":         id,
+			"name":       {"name", func(k core.APIKey) any { return k.Name }},
+			"created_at": {"created_at", func(k core.APIKey) any { return k.CreatedAt }},
+		},
+		defaultSort: "id",
+		scan: func(rows *sql.Rows) (core.APIKey, error) {
+			var scopes string
+			var k core.APIKey
+			if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &scopes, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt, &k.CreatedAt); err != nil {
+				return k, err
+			}
+			k.Scopes = strings.Split(scopes, ",")
+			return k, nil
+		},
+	}.page(db, p)
+}
+
+func CreateAPIKey(db *sql.DB, k core.APIKey) (int64, error) {
+	result, err := db.Exec("INSERT INTO api_key (user_id, name, prefix, key_hash, scopes, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		k.UserID, k.Name, k.Prefix, k.KeyHash, strings.Join(k.Scopes, ","), k.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// TouchAPIKey records the use of the key at most once a minute, so busy
+// scripts don't cause a write on every request.
+func TouchAPIKey(db *sql.DB, id int) error {
+	_, err := db.Exec("UPDATE api_key SET last_used_at = UTC_TIMESTAMP() WHERE id = ? AND (last_used_at IS NULL OR last_used_at < UTC_TIMESTAMP() - INTERVAL 1 MINUTE)", id)
+	return err
+}
+
+func RevokeAPIKey(db *sql.DB, userID, id int) error {
+	result, err := db.Exec("UPDATE api_key SET revoked_at = UTC_TIMESTAMP() WHERE id = ? AND user_id = ? AND revoked_at IS NULL", id, userID)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(result)
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"main/core"
+	"time"
+)
+
+func GetAttempts(db *sql.DB, key string) (*core.Attempts, error) {
+	row := db.QueryRow("SELECT * FROM auth_attempt WHERE attempt_key = ?", key)
+	var lastFailure string
+	var lockedUntil *string
+	var a core.Attempts
+	if err := row.Scan(&a.Key, &a.Failures, &lastFailure, &lockedUntil); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if a.LastFailure, err = time.Parse(time.DateTime, lastFailure); err != nil {
+		return nil, err
+	}
+
+	if lockedUntil != nil {
+		if a.LockedUntil, err = time.Parse(time.DateTime, *lockedUntil); err != nil {
+			return nil, err
+		}
+	}
+
+	return &a, nil
+}
+
+// AddFailure counts a failed attempt, starting over if the previous failure
+// happened before windowStart and the key isn't locked.
+func AddFailure(db *sql.DB, key string, now, windowStart time.Time) error {
+	_, err := db.Exec("INSERT INTO auth_attempt (attempt_key, failures, last_failure) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE failures = IF(last_failure < ? AND (locked_until IS NULL OR locked_until <= ?), 1, failures + 1), last_failure = VALUES(last_failure)",
+		key, now.UTC().Format(time.DateTime), windowStart.UTC().Format(time.DateTime), now.UTC().Format(time.DateTime))
+	return err
+}
+
+func LockAttempts(db *sql.DB, key string, until time.Time) error {
+	_, err := db.Exec("UPDATE auth_attempt SET locked_until = ? WHERE attempt_key = ?", until.UTC().Format(time.DateTime), key)
+	return err
+}
+
+func DeleteAttempts(db *sql.DB, key string) error {
+	_, err := db.Exec("DELETE FROM auth_attempt WHERE attempt_key = ?", key)
+	return err
+}
+
+func CreateSecurityEvent(db *sql.DB, e core.SecurityEvent) error {
+	_, err := db.Exec("INSERT INTO security_event (type, subject, ip) VALUES (?, ?, ?)", e.Type, e.Subject, e.IP)
+	return err
+}
@@ -18,3 +18,27 @@ func CreateUserAuth(db *sql.DB, ua core.UserAuthRecord) error {
 	_, err := db.Exec("INSERT INTO auth (user_id, auth_service, token) VALUES (?, ?, ?)", ua.UserID, ua.Service, ua.Token)
 	return err
 }
+
+func GetUserAuthsByUserID(db *sql.DB, userID int) ([]core.UserAuthRecord, error) {
+	rows, err := db.Query("SELECT * FROM auth WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []core.UserAuthRecord
+	for rows.Next() {
+		var ua core.UserAuthRecord
+		if err := rows.Scan(&ua.Token, &ua.Service, &ua.UserID); err != nil {
+			return nil, err
+		}
+		records = append(records, ua)
+	}
+
+	return records, nil
+}
+
+func DeleteUserAuth(db *sql.DB, userID int, authService string) error {
+	_, err := db.Exec("DELETE FROM auth WHERE user_id = ? AND auth_service = ?", userID, authService)
+	return err
+}
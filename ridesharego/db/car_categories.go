@@ -5,23 +5,23 @@ import (
 	"main/core"
 )
 
-func GetCarCategories(db *sql.DB) ([]core.CarCategory, error) {
-	rows, err := db.Query("SELECT * FROM car_category")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var categories []core.CarCategory
-	for rows.Next() {
-		var c core.CarCategory
-		if err := rows.Scan(&c.ID, &c.Name, &c.PassengerCount); err != nil {
-			return nil, err
-		}
-		categories = append(categories, c)
-	}
-
-	return categories, nil
+func GetCarCategories(db *sql.DB, p core.PageRequest) (*core.Page[core.CarCategory], error) {
+	id := sortField[core.CarCategory]{"id", func(c core.CarCategory) any { return c.ID }}
+	return listQuery[core.CarCategory]{
+		selectFrom: "SELECT * FROM car_category",
+		id:         id,
+		sorts: map[string]sortField[core.CarCategory]{
+			"id":              id,
+			"name":            {"name", func(c core.CarCategory) any { return c.Name }},
+			"passenger_count": {"passenger_count", func(c core.CarCategory) any { return c.PassengerCount }},
+		},
+		defaultSort: "id",
+		scan: func(rows *sql.Rows) (core.CarCategory, error) {
+			var c core.CarCategory
+			err := rows.Scan(&c.ID, &c.Name, &c.PassengerCount)
+			return c, err
+		},
+	}.page(db, p)
 }
 
 func GetCarCategoryByID(db *sql.DB, id int) (*core.CarCategory, error) {
@@ -33,6 +33,15 @@ func GetCarCategoryByID(db *sql.DB, id int) (*core.CarCategory, error) {
 	return &c, nil
 }
 
+func GetCarCategoryByCarID(db *sql.DB, carID int) (*core.CarCategory, error) {
+	row := db.QueryRow("SELECT car_category.* FROM car_category JOIN car_model ON car_model.category_id = car_category.id JOIN car ON car.model_id = car_model.id WHERE car.id = ?", carID)
+	var c core.CarCategory
+	if err := row.Scan(&c.ID, &c.Name, &c.PassengerCount); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 func CreateCarCategory(db *sql.DB, c core.CarCategory) (int64, error) {
 	result, err := db.Exec("INSERT INTO car_category (name, passenger_count) VALUES (?, ?)", c.Name, c.PassengerCount)
 	if err != nil {
@@ -5,23 +5,22 @@ import (
 	"main/core"
 )
 
-func GetCarMakes(db *sql.DB) ([]core.CarMake, error) {
-	rows, err := db.Query("SELECT * FROM car_make")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var makes []core.CarMake
-	for rows.Next() {
-		var m core.CarMake
-		if err := rows.Scan(&m.ID, &m.Name); err != nil {
-			return nil, err
-		}
-		makes = append(makes, m)
-	}
-
-	return makes, nil
+func GetCarMakes(db *sql.DB, p core.PageRequest) (*core.Page[core.CarMake], error) {
+	id := sortField[core.CarMake]{"id", func(m core.CarMake) any { return m.ID }}
+	return listQuery[core.CarMake]{
+		selectFrom: "SELECT * FROM car_make",
+		id:         id,
+		sorts: map[string]sortField[core.CarMake]{
+			"id":   id,
+			"name": {"name", func(m core.CarMake) any { return m.Name }},
+		},
+		defaultSort: "id",
+		scan: func(rows *sql.Rows) (core.CarMake, error) {
+			var m core.CarMake
+			err := rows.Scan(&m.ID, &m.Name)
+			return m, err
+		},
+	}.page(db, p)
 }
 
 func GetCarMakeByID(db *sql.DB, id int) (*core.CarMake, error) {
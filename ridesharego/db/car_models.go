@@ -5,23 +5,22 @@ import (
 	"main/core"
 )
 
-func GetCarModels(db *sql.DB) ([]core.CarModel, error) {
-	rows, err := db.Query("SELECT * FROM car_model")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var models []core.CarModel
-	for rows.Next() {
-		var m core.CarModel
-		if err := rows.Scan(&m.ID, &m.CategoryID, &m.MakeID, &m.Name); err != nil {
-			return nil, err
-		}
-		models = append(models, m)
-	}
-
-	return models, nil
+func GetCarModels(db *sql.DB, p core.PageRequest) (*core.Page[core.CarModel], error) {
+	id := sortField[core.CarModel]{"id", func(m core.CarModel) any { return m.ID }}
+	return listQuery[core.CarModel]{
+		selectFrom: "SELECT * FROM car_model",
+		id:         id,
+		sorts: map[string]sortField[core.CarModel]{
+			"id":   id,
+			"name": {"name", func(m core.CarModel) any { return m.Name }},
+		},
+		defaultSort: "id",
+		scan: func(rows *sql.Rows) (core.CarModel, error) {
+			var m core.CarModel
+			err := rows.Scan(&m.ID, &m.CategoryID, &m.MakeID, &m.Name)
+			return m, err
+		},
+	}.page(db, p)
 }
 
 func GetCarModelByID(db *sql.DB, id int) (*core.CarModel, error) {
@@ -5,23 +5,8 @@ import (
 	"main/core"
 )
 
-func GetCars(db *sql.DB) ([]core.Car, error) {
-	rows, err := db.Query("SELECT * FROM car")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var cars []core.Car
-	for rows.Next() {
-		var c core.Car
-		if err := rows.Scan(&c.ID, &c.LicensePlate, &c.UserID, &c.ModelID, &c.Year); err != nil {
-			return nil, err
-		}
-		cars = append(cars, c)
-	}
-
-	return cars, nil
+func GetCars(db *sql.DB, p core.PageRequest) (*core.Page[core.Car], error) {
+	return carList(nil, nil).page(db, p)
 }
 
 func GetCarByID(db *sql.DB, id int) (*core.Car, error) {
@@ -77,3 +62,28 @@ func GetCarsByUserID(db *sql.DB, userID int) ([]core.Car, error) {
 
 	return cars, nil
 }
+
+func GetCarsPageByUserID(db *sql.DB, userID int, p core.PageRequest) (*core.Page[core.Car], error) {
+	return carList([]string{"user_id = ?"}, []any{userID}).page(db, p)
+}
+
+func carList(conditions []string, args []any) listQuery[core.Car] {
+	id := sortField[core.Car]{"id", func(c core.Car) any { return c.ID }}
+	return listQuery[core.Car]{
+		selectFrom: "SELECT * FROM car",
+		conditions: conditions,
+		args:       args,
+		id:         id,
+		sorts: map[string]sortField[core.Car]{
+			"id":            id,
+			"license_plate": {"license_plate", func(c core.Car) any { return c.LicensePlate }},
+			"year":          {"year", func(c core.Car) any { return c.Year }},
+		},
+		defaultSort: "id",
+		scan: func(rows *sql.Rows) (core.Car, error) {
+			var c core.Car
+			err := rows.Scan(&c.ID, &c.LicensePlate, &c.UserID, &c.ModelID, &c.Year)
+			return c, err
+		},
+	}
+}
@@ -2,8 +2,10 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"main/core"
 	"net/http"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
@@ -26,13 +28,59 @@ func InitMySQL(log *logrus.Entry, cfg core.DBConfig) (*sql.DB, error) {
 }
 
 func SqlErrorToHTTP(err error) (string, int) {
-	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
-		if mysqlErr.Number == 1062 {
-			return "duplicate entry", http.StatusConflict
-		}
+	if IsDuplicateEntry(err) {
+		return "duplicate entry", http.StatusConflict
 	}
 	if err == sql.ErrNoRows {
 		return "not found", http.StatusNotFound
 	}
+	if err == ErrInvalidSort || err == ErrInvalidCursor {
+		return err.Error(), http.StatusBadRequest
+	}
+	if err == ErrStatusChanged || err == ErrSeatsBooked {
+		return err.Error(), http.StatusConflict
+	}
 	return "internal sever error", http.StatusInternalServerError
 }
+
+func IsDuplicateEntry(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+var (
+	// ErrStatusChanged is returned when a row changed status since it was
+	// read.
+	ErrStatusChanged = errors.New("status changed, try again")
+	// ErrSeatsBooked is returned when a ride would offer fewer seats than
+	// are booked.
+	ErrSeatsBooked = errors.New("more seats are booked than offered")
+)
+
+// requireAffected turns updates that matched no rows into sql.ErrNoRows.
+func requireAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// containsPattern is a LIKE pattern matching values that contain s, with the
+// wildcards in s escaped.
+func containsPattern(s string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + escaped + "%"
+}
@@ -5,23 +5,8 @@ import (
 	"main/core"
 )
 
-func GetFeedbacks(db *sql.DB) ([]core.Feedback, error) {
-	rows, err := db.Query("SELECT * FROM user_feedback")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var feedbacks []core.Feedback
-	for rows.Next() {
-		var f core.Feedback
-		if err := rows.Scan(&f.ID, &f.UserID, &f.RideID, &f.Score, &f.Message, &f.CreatedAt); err != nil {
-			return nil, err
-		}
-		feedbacks = append(feedbacks, f)
-	}
-
-	return feedbacks, nil
+func GetFeedbacks(db *sql.DB, p core.PageRequest) (*core.Page[core.Feedback], error) {
+	return feedbackList("SELECT * FROM user_feedback uf", nil, nil).page(db, p)
 }
 
 func GetFeedbackByID(db *sql.DB, id int) (*core.Feedback, error) {
@@ -33,60 +18,38 @@ func GetFeedbackByID(db *sql.DB, id int) (*core.Feedback, error) {
 	return &f, nil
 }
 
-func GetFeedbacksByUserID(db *sql.DB, userID int) ([]core.Feedback, error) {
-	rows, err := db.Query("SELECT * FROM user_feedback WHERE owner_user_id = ?", userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var feedbacks []core.Feedback
-	for rows.Next() {
-		var f core.Feedback
-		if err := rows.Scan(&f.ID, &f.UserID, &f.RideID, &f.Score, &f.Message, &f.CreatedAt); err != nil {
-			return nil, err
-		}
-		feedbacks = append(feedbacks, f)
-	}
-
-	return feedbacks, nil
+func GetFeedbacksByUserID(db *sql.DB, userID int, p core.PageRequest) (*core.Page[core.Feedback], error) {
+	return feedbackList("SELECT * FROM user_feedback uf", []string{"uf.owner_user_id = ?"}, []any{userID}).page(db, p)
 }
 
-func GetFeedbacksByRideID(db *sql.DB, rideID int) ([]core.Feedback, error) {
-	rows, err := db.Query("SELECT * FROM user_feedback WHERE ride_id = ?", rideID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var feedbacks []core.Feedback
-	for rows.Next() {
-		var f core.Feedback
-		if err := rows.Scan(&f.ID, &f.UserID, &f.RideID, &f.Score, &f.Message, &f.CreatedAt); err != nil {
-			return nil, err
-		}
-		feedbacks = append(feedbacks, f)
-	}
-
-	return feedbacks, nil
+func GetFeedbacksByRideID(db *sql.DB, rideID int, p core.PageRequest) (*core.Page[core.Feedback], error) {
+	return feedbackList("SELECT * FROM user_feedback uf", []string{"uf.ride_id = ?"}, []any{rideID}).page(db, p)
 }
 
-func GetFeedbackByUserIDAndRideID(db *sql.DB, userID, rideID int) ([]core.Feedback, error) {
-	rows, err := db.Query("SELECT uf.id, uf.owner_user_id, uf.ride_id, uf.score, uf.message, uf.created_at FROM user_feedback uf LEFT JOIN ride r ON r.id = uf.ride_id WHERE r.owner_user_id = ? AND uf.ride_id = ?", userID, rideID)
-	if err != nil {
-		return nil, err
-	}
+func GetFeedbackByUserIDAndRideID(db *sql.DB, userID, rideID int, p core.PageRequest) (*core.Page[core.Feedback], error) {
+	return feedbackList("SELECT uf.id, uf.owner_user_id, uf.ride_id, uf.score, uf.message, uf.created_at FROM user_feedback uf LEFT JOIN ride r ON r.id = uf.ride_id",
+		[]string{"r.owner_user_id = ?", "uf.ride_id = ?"}, []any{userID, rideID}).page(db, p)
+}
 
-	var feedbacks []core.Feedback
-	for rows.Next() {
-		var f core.Feedback
-		if err := rows.Scan(&f.ID, &f.UserID, &f.RideID, &f.Score, &f.Message, &f.CreatedAt); err != nil {
-			return nil, err
-		}
-		feedbacks = append(feedbacks, f)
+func feedbackList(selectFrom string, conditions []string, args []any) listQuery[core.Feedback] {
+	id := sortField[core.Feedback]{"uf.id", func(f core.Feedback) any { return f.ID }}
+	return listQuery[core.Feedback]{
+		selectFrom: selectFrom,
+		conditions: conditions,
+		args:       args,
+		id:         id,
+		sorts: map[string]sortField[core.Feedback]{
+			"id":         id,
+			"score":      {"uf.score", func(f core.Feedback) any { return f.Score }},
+			"created_at": {"uf.created_at", func(f core.Feedback) any { return f.CreatedAt }},
+		},
+		defaultSort: "id",
+		scan: func(rows *sql.Rows) (core.Feedback, error) {
+			var f core.Feedback
+			err := rows.Scan(&f.ID, &f.UserID, &f.RideID, &f.Score, &f.Message, &f.CreatedAt)
+			return f, err
+		},
 	}
-
-	return feedbacks, nil
 }
 
 func CreateFeedback(db *sql.DB, f core.Feedback) (int64, error) {
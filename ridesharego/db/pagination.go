@@ -0,0 +1,173 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/core"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+var (
+	ErrInvalidSort   = errors.New("invalid sort")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// sortField is a column a list can be sorted by, together with the value of
+// that column in a scanned item, which the cursor continues from.
+type sortField[T any] struct {
+	column string
+	value  func(T) any
+}
+
+// listQuery is a SELECT that is read a page at a time. Rows are ordered by
+// the requested field and then by id, and every page starts after the last
+// row of the previous one, so rows added or removed in the meantime don't
+// shift the pages.
+type listQuery[T any] struct {
+	// selectFrom is the query up to the WHERE clause
+	selectFrom  string
+	conditions  []string
+	args        []any
+	id          sortField[T]
+	sorts       map[string]sortField[T]
+	defaultSort string
+	scan        func(*sql.Rows) (T, error)
+}
+
+type cursor struct {
+	Sort  string `json:"s"`
+	Value any    `json:"v"`
+	ID    any    `json:"i"`
+}
+
+func (q listQuery[T]) page(db *sql.DB, p core.PageRequest) (*core.Page[T], error) {
+	sort := p.Sort
+	if sort == "" {
+		sort = q.defaultSort
+	}
+
+	name, desc := strings.CutPrefix(sort, "-")
+	field, ok := q.sorts[name]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+
+	limit := p.Limit
+	if limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM ("+q.query(q.conditions)+") AS list", q.args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	conditions := append([]string{}, q.conditions...)
+	args := append([]any{}, q.args...)
+
+	if p.Cursor != "" {
+		c, err := decodeCursor(p.Cursor)
+		if err != nil || c.Sort != sort {
+			return nil, ErrInvalidCursor
+		}
+
+		operator := ">"
+		if desc {
+			operator = "<"
+		}
+
+		if field.column == q.id.column {
+			conditions = append(conditions, fmt.Sprintf("%s %s ?", q.id.column, operator))
+			args = append(args, c.ID)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?))", field.column, operator, field.column, q.id.column, operator))
+			args = append(args, c.Value, c.Value, c.ID)
+		}
+	}
+
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+
+	// one row more than asked tells whether there is a next page
+	query := q.query(conditions) + fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT %d", field.column, direction, q.id.column, direction, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []T{}
+	for rows.Next() {
+		item, err := q.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &core.Page[T]{Items: items, Total: total}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = encodeCursor(cursor{Sort: sort, Value: field.value(last), ID: q.id.value(last)})
+	}
+
+	return page, nil
+}
+
+func (q listQuery[T]) query(conditions []string) string {
+	if len(conditions) == 0 {
+		return q.selectFrom
+	}
+	return q.selectFrom + " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// numbers are kept as written so large IDs stay exact
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var c cursor
+	if err := decoder.Decode(&c); err != nil {
+		return nil, err
+	}
+
+	for _, value := range []any{c.Value, c.ID} {
+		switch value.(type) {
+		case string, json.Number:
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return &c, nil
+}
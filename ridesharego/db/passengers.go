@@ -3,10 +3,16 @@ package db
 import (
 	"database/sql"
 	"main/core"
+	"strings"
+	"time"
 )
 
 func GetPassengersByRideID(db *sql.DB, rideID int) ([]core.Passenger, error) {
-	rows, err := db.Query("SELECT * FROM ride_passenger WHERE ride_id = ?", rideID)
+	return getPassengers(db, rideID)
+}
+
+func getPassengers(q queryer, rideID int) ([]core.Passenger, error) {
+	rows, err := q.Query("SELECT * FROM ride_passenger WHERE ride_id = ?", rideID)
 	if err != nil {
 		return nil, err
 	}
@@ -14,35 +20,301 @@ func GetPassengersByRideID(db *sql.DB, rideID int) ([]core.Passenger, error) {
 
 	var passengers []core.Passenger
 	for rows.Next() {
-		var rp core.Passenger
-		if err := rows.Scan(&rp.RideID, &rp.PassengerID, &rp.CreatedAt); err != nil {
+		rp, err := scanPassenger(rows)
+		if err != nil {
 			return nil, err
 		}
-		passengers = append(passengers, rp)
+		passengers = append(passengers, *rp)
+	}
+
+	return passengers, rows.Err()
+}
+
+// GetPassengersPageByRideID returns a page of the bookings of a ride that
+// match the filter.
+func GetPassengersPageByRideID(db *sql.DB, rideID int, f core.PassengerFilter, p core.PageRequest) (*core.Page[core.Passenger], error) {
+	conditions := []string{"ride_id = ?"}
+	args := []any{rideID}
+	if len(f.Statuses) > 0 {
+		conditions = append(conditions, "status IN (?"+strings.Repeat(", ?", len(f.Statuses)-1)+")")
+		for _, status := range f.Statuses {
+			args = append(args, status)
+		}
+	}
+
+	if f.MinReliability > 0 {
+		score := reliabilityScore("ride_passenger.passenger_id")
+		conditions = append(conditions, "("+score+" IS NULL OR "+score+" >= ?)")
+		args = append(args, f.MinReliability)
 	}
 
-	return passengers, nil
+	id := sortField[core.Passenger]{"passenger_id", func(rp core.Passenger) any { return rp.PassengerID }}
+	return listQuery[core.Passenger]{
+		selectFrom: "SELECT * FROM ride_passenger",
+		conditions: conditions,
+		args:       args,
+		id:         id,
+		sorts: map[string]sortField[core.Passenger]{
+			"passenger_id": id,
+			"created_at":   {"created_at", func(rp core.Passenger) any { return rp.CreatedAt }},
+			"seats":        {"seats", func(rp core.Passenger) any { return rp.Seats }},
+		},
+		defaultSort: "created_at",
+		scan: func(rows *sql.Rows) (core.Passenger, error) {
+			rp, err := scanPassenger(rows)
+			if err != nil {
+				return core.Passenger{}, err
+			}
+			return *rp, nil
+		},
+	}.page(db, p)
 }
 
 func GetPassengerByRideIDAndUserID(db *sql.DB, rideID, userID int) (*core.Passenger, error) {
-	row := db.QueryRow("SELECT * FROM ride_passenger WHERE ride_id = ? AND passenger_id = ?", rideID, userID)
+	return scanPassenger(db.QueryRow("SELECT * FROM ride_passenger WHERE ride_id = ? AND passenger_id = ?", rideID, userID))
+}
+
+func scanPassenger(row scanner) (*core.Passenger, error) {
 	var rp core.Passenger
-	if err := row.Scan(&rp.RideID, &rp.PassengerID, &rp.CreatedAt); err != nil {
+	if err := row.Scan(&rp.RideID, &rp.PassengerID, &rp.Seats, &rp.CreatedAt, &rp.Status, &rp.Reason, &rp.DecidedAt); err != nil {
 		return nil, err
 	}
 	return &rp, nil
 }
 
-func CreatePassenger(db *sql.DB, rp core.Passenger) error {
-	_, err := db.Exec("INSERT INTO ride_passenger (ride_id, passenger_id) VALUES (?, ?)", rp.RideID, rp.PassengerID)
+// BookSeat books the seats of the passenger if check accepts the ride and
+// its passengers. The booking is pending if the ride needs the driver's
+// approval and accepted otherwise. The ride row is locked for the whole
+// transaction, so concurrent bookings of one ride run one after the other
+// and each sees the seats taken by the ones before it.
+func BookSeat(db *sql.DB, rp core.Passenger, check func(ride *core.Ride, passengers []core.Passenger) error) (*core.Passenger, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ride, err := lockRide(tx, rp.RideID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	passengers, err := getPassengers(tx, rp.RideID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := check(ride, passengers); err != nil {
+		return nil, err
+	}
+
+	rp.Status = core.PassengerAccepted
+	if ride.ManualApproval {
+		rp.Status = core.PassengerPending
+	}
+
+	if err := insertBooking(tx, rp); err != nil {
+		return nil, err
+	}
+
+	// a booked rider no longer waits for seats
+	if _, err := tx.Exec("DELETE FROM ride_waitlist WHERE ride_id = ? AND user_id = ?", rp.RideID, rp.PassengerID); err != nil {
+		return nil, err
+	}
+
+	booking, err := scanPassenger(tx.QueryRow("SELECT * FROM ride_passenger WHERE ride_id = ? AND passenger_id = ?", rp.RideID, rp.PassengerID))
+	if err != nil {
+		return nil, err
+	}
+
+	return booking, tx.Commit()
 }
 
-func DeletePassenger(db *sql.DB, rideID, userID int) error {
-	_, err := db.Exec("DELETE FROM ride_passenger WHERE ride_id = ? AND passenger_id = ?", rideID, userID)
+// insertBooking stores a booking, replacing an expired request of the same
+// rider.
+func insertBooking(q queryer, rp core.Passenger) error {
+	_, err := q.Exec("INSERT INTO ride_passenger (ride_id, passenger_id, seats, status) VALUES (?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE seats = VALUES(seats), status = VALUES(status), reason = NULL, decided_at = NULL, created_at = CURRENT_TIMESTAMP()",
+		rp.RideID, rp.PassengerID, rp.Seats, rp.Status)
 	return err
 }
+
+// DecideBooking accepts or rejects a pending booking if check accepts the
+// ride and the booking as they are with the ride locked. It fails with
+// ErrStatusChanged if the booking is no longer pending. The seats of a
+// rejected booking go to the waitlist, the bookings made for it are
+// returned.
+func DecideBooking(db *sql.DB, rideID, userID int, status string, reason *string, check func(ride *core.Ride, booking *core.Passenger) error) ([]core.Passenger, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ride, err := lockRide(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+
+	booking, err := scanPassenger(tx.QueryRow("SELECT * FROM ride_passenger WHERE ride_id = ? AND passenger_id = ?", rideID, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := check(ride, booking); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec("UPDATE ride_passenger SET status = ?, reason = ?, decided_at = NOW() WHERE ride_id = ? AND passenger_id = ? AND status = 'pending'",
+		status, reason, rideID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := requireAffected(result); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrStatusChanged
+		}
+		return nil, err
+	}
+
+	var promoted []core.Passenger
+	if status == core.PassengerRejected {
+		if promoted, err = promoteWaitlist(tx, rideID); err != nil {
+			return nil, err
+		}
+	}
+
+	return promoted, tx.Commit()
+}
+
+// ExpirePendingBookings expires the requests still pending when their ride
+// starts within deadline, which frees their seats for the waitlist. It
+// returns how many bookings expired and the rides whose waitlist got seats.
+func ExpirePendingBookings(db *sql.DB, deadline time.Duration) (int64, []core.WaitlistPromotion, error) {
+	rows, err := db.Query("SELECT DISTINCT ride_passenger.ride_id FROM ride_passenger JOIN ride ON ride.id = ride_passenger.ride_id "+
+		"WHERE ride_passenger.status = 'pending' AND ride.start_date <= NOW() + INTERVAL ? SECOND",
+		int(deadline.Seconds()))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var rideIDs []int
+	for rows.Next() {
+		var rideID int
+		if err := rows.Scan(&rideID); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		rideIDs = append(rideIDs, rideID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	var expired int64
+	var promotions []core.WaitlistPromotion
+	for _, rideID := range rideIDs {
+		count, promotion, err := expireRideBookings(db, rideID, deadline)
+		if err != nil {
+			return expired, promotions, err
+		}
+
+		expired += count
+		if len(promotion.Promoted) > 0 {
+			promotions = append(promotions, *promotion)
+		}
+	}
+
+	return expired, promotions, nil
+}
+
+// expireRideBookings expires the pending requests of one ride and promotes
+// its waitlist, with the ride locked like for any other change of its seats.
+func expireRideBookings(db *sql.DB, rideID int, deadline time.Duration) (int64, *core.WaitlistPromotion, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	ride, err := lockRide(tx, rideID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	result, err := tx.Exec("UPDATE ride_passenger JOIN ride ON ride.id = ride_passenger.ride_id "+
+		"SET ride_passenger.status = 'expired', ride_passenger.decided_at = NOW() "+
+		"WHERE ride_passenger.ride_id = ? AND ride_passenger.status = 'pending' AND ride.start_date <= NOW() + INTERVAL ? SECOND",
+		rideID, int(deadline.Seconds()))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	expired, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	promotion := &core.WaitlistPromotion{Ride: *ride}
+	if expired > 0 {
+		if promotion.Promoted, err = promoteWaitlist(tx, rideID); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return expired, promotion, tx.Commit()
+}
+
+// DeletePassenger removes a booking if check accepts the ride and the
+// booking, and gives its seats to the waitlist. The bookings made for it are
+// returned. check runs with the ride locked and also reports whether the
+// cancellation is late, which is recorded for the reliability score of the
+// passenger.
+func DeletePassenger(db *sql.DB, rideID, userID int, check func(ride *core.Ride, booking *core.Passenger) (bool, error)) ([]core.Passenger, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ride, err := lockRide(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+
+	booking, err := scanPassenger(tx.QueryRow("SELECT * FROM ride_passenger WHERE ride_id = ? AND passenger_id = ?", rideID, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	late, err := check(ride, booking)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec("DELETE FROM ride_passenger WHERE ride_id = ? AND passenger_id = ?", rideID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := requireAffected(result); err != nil {
+		return nil, err
+	}
+
+	// a passenger who booked and cancelled late again only counts once
+	if late {
+		_, err := tx.Exec("INSERT IGNORE INTO passenger_incident (ride_id, user_id, kind) VALUES (?, ?, ?)", rideID, userID, core.IncidentLateCancellation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	promoted, err := promoteWaitlist(tx, rideID)
+	if err != nil {
+		return nil, err
+	}
+
+	return promoted, tx.Commit()
+}
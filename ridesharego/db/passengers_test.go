@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"main/core"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDSNEnv holds the DSN of a MySQL database set up with init.sql. The
+// tests that need a database are skipped without it.
+const testDSNEnv = "RIDESHARE_TEST_DSN"
+
+func openTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	d, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	if err := d.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+// createTestUser adds a user that is deleted with everything it owns when
+// the test ends.
+func createTestUser(t *testing.T, d *sql.DB, name string) int {
+	email := fmt.Sprintf("%s-%d@test.rideshare", name, time.Now().UnixNano())
+	id, err := CreateUser(d, core.User{Name: name, Email: email, Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeleteUser(d, int(id)) })
+
+	return int(id)
+}
+
+func createTestRide(t *testing.T, d *sql.DB, seats int, manualApproval bool) int {
+	driverID := createTestUser(t, d, "driver")
+
+	var modelID int
+	if err := d.QueryRow("SELECT id FROM car_model LIMIT 1").Scan(&modelID); err != nil {
+		t.Fatal(err)
+	}
+
+	carID, err := CreateCar(d, core.Car{UserID: driverID, LicensePlate: "TEST", Year: 2020, ModelID: modelID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rideID, err := CreateRide(d, core.Ride{
+		OwnerID:        driverID,
+		VehicleID:      int(carID),
+		StartDate:      time.Now().Add(24 * time.Hour).Format("2006-01-02 15:04:05"),
+		StartCity:      "Test",
+		StartAddress:   "Start 1",
+		EndCity:        "Test",
+		EndAddress:     "End 1",
+		SeatsOffered:   seats,
+		ManualApproval: manualApproval,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return int(rideID)
+}
+
+// TestBookSeatConcurrent books one seat for many riders at once, only as many
+// as the ride offers may get one.
+func TestBookSeatConcurrent(t *testing.T) {
+	d := openTestDB(t)
+
+	const seats = 3
+	const riders = 20
+
+	for _, manualApproval := range []bool{false, true} {
+		t.Run(fmt.Sprintf("manual_approval=%t", manualApproval), func(t *testing.T) {
+			rideID := createTestRide(t, d, seats, manualApproval)
+
+			passengerIDs := make([]int, riders)
+			for i := range passengerIDs {
+				passengerIDs[i] = createTestUser(t, d, fmt.Sprintf("rider%d", i))
+			}
+
+			// the seats taken are sampled while the bookings run
+			done := make(chan struct{})
+			sampled := make(chan int)
+			go func() {
+				maxTaken := 0
+				for {
+					select {
+					case <-done:
+						sampled <- maxTaken
+						return
+					default:
+					}
+
+					var taken int
+					err := d.QueryRow("SELECT COALESCE(SUM(seats), 0) FROM ride_passenger WHERE ride_id = ? AND status IN ('pending', 'accepted')", rideID).Scan(&taken)
+					if err == nil && taken > maxTaken {
+						maxTaken = taken
+					}
+				}
+			}()
+
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			booked := 0
+			for _, passengerID := range passengerIDs {
+				wg.Add(1)
+				go func(passengerID int) {
+					defer wg.Done()
+					<-start
+
+					p := core.Passenger{RideID: rideID, PassengerID: passengerID, Seats: 1}
+					_, err := BookSeat(d, p, func(ride *core.Ride, passengers []core.Passenger) error {
+						return p.Validate(ride, passengers)
+					})
+					if err == nil {
+						mu.Lock()
+						booked++
+						mu.Unlock()
+					}
+				}(passengerID)
+			}
+
+			close(start)
+			wg.Wait()
+			close(done)
+			maxTaken := <-sampled
+
+			if booked != seats {
+				t.Errorf("%d bookings succeeded, want %d", booked, seats)
+			}
+
+			if maxTaken > seats {
+				t.Errorf("%d seats were taken at once, only %d are offered", maxTaken, seats)
+			}
+
+			ride, err := GetRideByID(d, rideID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ride.SeatsTaken != seats {
+				t.Errorf("%d seats taken after booking, want %d", ride.SeatsTaken, seats)
+			}
+		})
+	}
+}
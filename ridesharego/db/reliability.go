@@ -0,0 +1,57 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"main/core"
+)
+
+// reliabilityCounts are the SQL expressions of the counts behind the
+// reliability score of the user whose ID is in column.
+func reliabilityCounts(column string) (trips, late, noShows string) {
+	completed := fmt.Sprintf("(SELECT COUNT(*) FROM ride_passenger rp JOIN ride r ON r.id = rp.ride_id "+
+		"WHERE rp.passenger_id = %s AND rp.status = 'accepted' AND r.status = 'completed')", column)
+	late = fmt.Sprintf("(SELECT COUNT(*) FROM passenger_incident i WHERE i.user_id = %s AND i.kind = '%s')", column, core.IncidentLateCancellation)
+	noShows = fmt.Sprintf("(SELECT COUNT(*) FROM passenger_incident i WHERE i.user_id = %s AND i.kind = '%s')", column, core.IncidentNoShow)
+	return "(" + completed + " + " + late + ")", late, noShows
+}
+
+// reliabilityScore is the SQL expression of the reliability score, see
+// core.Reliability. It is NULL for users without trips.
+func reliabilityScore(column string) string {
+	trips, late, noShows := reliabilityCounts(column)
+	return fmt.Sprintf("(CASE WHEN %[1]s = 0 THEN NULL ELSE CAST(GREATEST(0, ROUND(100 * (%[1]s - %[2]s - 2 * %[3]s) / %[1]s)) AS SIGNED) END)",
+		trips, late, noShows)
+}
+
+func GetUserReliability(db *sql.DB, userID int) (*core.Reliability, error) {
+	trips, late, noShows := reliabilityCounts("user.id")
+	row := db.QueryRow(fmt.Sprintf("SELECT %s, %s, %s, %s FROM user WHERE user.id = ?", trips, late, noShows, reliabilityScore("user.id")), userID)
+
+	var r core.Reliability
+	if err := row.Scan(&r.Trips, &r.LateCancellations, &r.NoShows, &r.Score); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ReportNoShow records that the passenger didn't show up for the ride. A
+// passenger is reported once per ride, again is a duplicate entry.
+func ReportNoShow(db *sql.DB, rideID, userID int) (*core.Incident, error) {
+	result, err := db.Exec("INSERT INTO passenger_incident (ride_id, user_id, kind) VALUES (?, ?, ?)", rideID, userID, core.IncidentNoShow)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	row := db.QueryRow("SELECT * FROM passenger_incident WHERE id = ?", id)
+	var i core.Incident
+	if err := row.Scan(&i.ID, &i.RideID, &i.UserID, &i.Kind, &i.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
@@ -2,41 +2,215 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 	"main/core"
+	"math"
+	"strconv"
+	"strings"
 )
 
-func GetRideByID(db *sql.DB, id int) (*core.Ride, error) {
-	row := db.QueryRow("SELECT * FROM ride WHERE id = ?", id)
+const (
+	metersPerDegree = 111320
+	// unlocatedDetour ranks rides without coordinates, found by city, after
+	// all rides found by distance
+	unlocatedDetour = 1e12
+)
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// seatsTaken counts the seats held by the pending and accepted bookings of a
+// ride.
+const seatsTaken = "(SELECT COALESCE(SUM(ride_passenger.seats), 0) FROM ride_passenger WHERE ride_passenger.ride_id = ride.id AND ride_passenger.status IN ('pending', 'accepted'))"
+
+// rideSelect reads rides together with their booked seats and coordinates.
+// detour is the SQL expression of the detour distance, or NULL outside of
+// radius searches.
+func rideSelect(detour string) string {
+	return "SELECT ride.*, " + seatsTaken + ", ST_Latitude(l.start_point), ST_Longitude(l.start_point), ST_Latitude(l.end_point), ST_Longitude(l.end_point), " +
+		detour + " FROM ride LEFT JOIN ride_location l ON l.ride_id = ride.id"
+}
+
+func scanRide(row scanner) (core.Ride, error) {
 	var r core.Ride
-	err := row.Scan(&r.ID, &r.OwnerID, &r.VehicleID, &r.StartDate, &r.StartCity, &r.StartAddress, &r.EndCity, &r.EndAddress, &r.CreatedAt)
+	var startLat, startLng, endLat, endLng *float64
+	if err := row.Scan(&r.ID, &r.OwnerID, &r.VehicleID, &r.StartDate, &r.StartCity, &r.StartAddress, &r.EndCity, &r.EndAddress, &r.SeatsOffered, &r.ManualApproval, &r.CancellationCutoff, &r.CreatedAt,
+		&r.Status, &r.BoardingAt, &r.StartedAt, &r.CompletedAt, &r.CancelledAt,
+		&r.SeatsTaken, &startLat, &startLng, &endLat, &endLng, &r.DetourDistance); err != nil {
+		return r, err
+	}
+
+	r.SeatsFree = max(r.SeatsOffered-r.SeatsTaken, 0)
+
+	if startLat != nil && startLng != nil {
+		r.StartLocation = &core.GeoPoint{Lat: *startLat, Lng: *startLng}
+	}
+
+	if endLat != nil && endLng != nil {
+		r.EndLocation = &core.GeoPoint{Lat: *endLat, Lng: *endLng}
+	}
+
+	return r, nil
+}
+
+func GetRideByID(db *sql.DB, id int) (*core.Ride, error) {
+	r, err := scanRide(db.QueryRow(rideSelect("NULL")+" WHERE ride.id = ?", id))
 	if err != nil {
 		return nil, err
 	}
 	return &r, nil
 }
 
-func GetRides(db *sql.DB) ([]core.Ride, error) {
-	rows, err := db.Query("SELECT * FROM ride")
-	if err != nil {
-		return nil, err
+// GetRides returns a page of the rides matching the filter, soonest first
+// unless sorted otherwise. Radius searches are ranked by detour distance
+// instead. Free seats are the seats offered by the driver minus the booked
+// seats. Text comparisons rely on the case-insensitive default collation,
+// which keeps the city indexes usable.
+func GetRides(db *sql.DB, f core.RideFilter, p core.PageRequest) (*core.Page[core.Ride], error) {
+	var conditions []string
+	var args []any
+	var detours []string
+
+	if f.StartNear != nil {
+		condition, distance := nearCondition("l.start_point", *f.StartNear, f.StartRadius)
+		if f.StartCity != "" {
+			condition = fmt.Sprintf("(%s OR (l.ride_id IS NULL AND ride.start_city = ?))", condition)
+			args = append(args, f.StartCity)
+		}
+		conditions = append(conditions, condition)
+		detours = append(detours, distance)
+	} else if f.StartCity != "" {
+		conditions = append(conditions, "ride.start_city = ?")
+		args = append(args, f.StartCity)
+	}
+
+	if f.EndNear != nil {
+		condition, distance := nearCondition("l.end_point", *f.EndNear, f.EndRadius)
+		if f.EndCity != "" {
+			condition = fmt.Sprintf("(%s OR (l.ride_id IS NULL AND ride.end_city = ?))", condition)
+			args = append(args, f.EndCity)
+		}
+		conditions = append(conditions, condition)
+		detours = append(detours, distance)
+	} else if f.EndCity != "" {
+		conditions = append(conditions, "ride.end_city = ?")
+		args = append(args, f.EndCity)
+	}
+
+	detour := "NULL"
+	if len(detours) > 0 {
+		detour = strings.Join(detours, " + ")
+	}
+	query := rideSelect(detour)
+
+	if f.MinFreeSeats > 0 {
+		conditions = append(conditions, "ride.seats_offered - "+seatsTaken+" >= ?")
+		args = append(args, f.MinFreeSeats)
+	}
+
+	if f.StartAddress != "" {
+		conditions = append(conditions, "ride.start_address LIKE ?")
+		args = append(args, containsPattern(f.StartAddress))
+	}
+
+	if f.EndAddress != "" {
+		conditions = append(conditions, "ride.end_address LIKE ?")
+		args = append(args, containsPattern(f.EndAddress))
+	}
+
+	if f.DateFrom != "" {
+		conditions = append(conditions, "ride.start_date >= ?")
+		args = append(args, f.DateFrom)
+	}
+
+	if f.DateTo != "" {
+		conditions = append(conditions, "ride.start_date <= ?")
+		args = append(args, f.DateTo)
 	}
-	defer rows.Close()
 
-	var rides []core.Ride
-	for rows.Next() {
-		var r core.Ride
-		if err := rows.Scan(&r.ID, &r.OwnerID, &r.VehicleID, &r.StartDate, &r.StartCity, &r.StartAddress, &r.EndCity, &r.EndAddress, &r.CreatedAt); err != nil {
-			return nil, err
+	if f.OwnerID != 0 {
+		conditions = append(conditions, "ride.owner_user_id = ?")
+		args = append(args, f.OwnerID)
+	}
+
+	if len(f.Statuses) > 0 {
+		conditions = append(conditions, "ride.status IN (?"+strings.Repeat(", ?", len(f.Statuses)-1)+")")
+		for _, status := range f.Statuses {
+			args = append(args, status)
+		}
+	}
+
+	list := rideList(query, conditions, args)
+	if len(detours) > 0 {
+		list.sorts["detour"] = sortField[core.Ride]{
+			column: fmt.Sprintf("COALESCE(%s, %g)", detour, float64(unlocatedDetour)),
+			value: func(r core.Ride) any {
+				if r.DetourDistance == nil {
+					return float64(unlocatedDetour)
+				}
+				return *r.DetourDistance
+			},
 		}
-		rides = append(rides, r)
+		list.defaultSort = "detour"
+	}
+
+	return list.page(db, p)
+}
+
+// nearCondition matches points within radius meters of the center and
+// returns it with the expression of the distance. The bounding box lets MySQL
+// use the spatial index before the exact distance is computed.
+func nearCondition(column string, center core.GeoPoint, radius float64) (string, string) {
+	distance := fmt.Sprintf("ST_Distance_Sphere(%s, %s)", column, pointSQL(center))
+	condition := fmt.Sprintf("%s <= %s", distance, formatFloat(radius))
+
+	// a little larger than the radius so the box never cuts off a match
+	latDelta := radius * 1.01 / metersPerDegree
+	lngDelta := latDelta / math.Cos((math.Abs(center.Lat)+latDelta)*math.Pi/180)
+
+	minLat, maxLat := center.Lat-latDelta, center.Lat+latDelta
+	minLng, maxLng := center.Lng-lngDelta, center.Lng+lngDelta
+
+	// boxes reaching over a pole or the antimeridian would wrap around, those
+	// rare searches only use the distance
+	if minLat < -90 || maxLat > 90 || minLng < -180 || maxLng > 180 {
+		return "(" + condition + ")", distance
 	}
 
-	return rides, nil
+	box := fmt.Sprintf("ST_GeomFromText('POLYGON((%s %s, %s %s, %s %s, %s %s, %s %s))', 4326, 'axis-order=lat-long')",
+		formatFloat(minLat), formatFloat(minLng),
+		formatFloat(maxLat), formatFloat(minLng),
+		formatFloat(maxLat), formatFloat(maxLng),
+		formatFloat(minLat), formatFloat(maxLng),
+		formatFloat(minLat), formatFloat(minLng))
+
+	return fmt.Sprintf("(MBRContains(%s, %s) AND %s)", box, column, condition), distance
+}
+
+// pointSQL is the SQL literal of a point. Coordinates are formatted floats,
+// which keeps the expression free of user input.
+func pointSQL(p core.GeoPoint) string {
+	return fmt.Sprintf("ST_GeomFromText('%s', 4326, 'axis-order=lat-long')", pointWKT(p))
+}
+
+func pointWKT(p core.GeoPoint) string {
+	return fmt.Sprintf("POINT(%s %s)", formatFloat(p.Lat), formatFloat(p.Lng))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
 }
 
 func CreateRide(db *sql.DB, r core.Ride) (int64, error) {
-	result, err := db.Exec("INSERT INTO ride (owner_user_id, vehicle_id, start_date, start_city, start_address, end_city, end_address) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		r.OwnerID, r.VehicleID, r.StartDate, r.StartCity, r.StartAddress, r.EndCity, r.EndAddress)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO ride (owner_user_id, vehicle_id, start_date, start_city, start_address, end_city, end_address, seats_offered, manual_approval, cancellation_cutoff) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.OwnerID, r.VehicleID, r.StartDate, r.StartCity, r.StartAddress, r.EndCity, r.EndAddress, r.SeatsOffered, r.ManualApproval, r.CancellationCutoff)
 	if err != nil {
 		return 0, err
 	}
@@ -46,35 +220,158 @@ func CreateRide(db *sql.DB, r core.Ride) (int64, error) {
 		return 0, err
 	}
 
-	return id, nil
+	if err := saveRideLocation(tx, int(id), r); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
 }
 
-func UpdateRide(db *sql.DB, id int, r core.Ride) error {
-	_, err := db.Exec("UPDATE ride SET owner_user_id = ?, vehicle_id = ?, start_date = ?, start_city = ?, start_address = ?, end_city = ?, end_address = ? WHERE id = ?",
-		r.OwnerID, r.VehicleID, r.StartDate, r.StartCity, r.StartAddress, r.EndCity, r.EndAddress, id)
-	return err
+// UpdateRide changes a ride if check accepts it and its passengers, it fails
+// with ErrSeatsBooked if fewer seats would be offered than are booked. The
+// ride row is locked like in BookSeat so no booking or status change slips in
+// between. Added seats go to the waitlist, the bookings made for it are
+// returned.
+func UpdateRide(db *sql.DB, id int, r core.Ride, check func(ride *core.Ride, passengers []core.Passenger) error) ([]core.Passenger, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ride, err := lockRide(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	passengers, err := getPassengers(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := check(ride, passengers); err != nil {
+		return nil, err
+	}
+
+	if ride.SeatsTaken > r.SeatsOffered {
+		return nil, ErrSeatsBooked
+	}
+
+	_, err = tx.Exec("UPDATE ride SET owner_user_id = ?, vehicle_id = ?, start_date = ?, start_city = ?, start_address = ?, end_city = ?, end_address = ?, seats_offered = ?, manual_approval = ?, cancellation_cutoff = ? WHERE id = ?",
+		r.OwnerID, r.VehicleID, r.StartDate, r.StartCity, r.StartAddress, r.EndCity, r.EndAddress, r.SeatsOffered, r.ManualApproval, r.CancellationCutoff, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveRideLocation(tx, id, r); err != nil {
+		return nil, err
+	}
+
+	promoted, err := promoteWaitlist(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return promoted, tx.Commit()
 }
 
-func DeleteRide(db *sql.DB, id int) error {
-	_, err := db.Exec("DELETE FROM ride WHERE id = ?", id)
+// saveRideLocation stores the coordinates of the ride, or removes them if
+// the ride has none.
+func saveRideLocation(tx *sql.Tx, id int, r core.Ride) error {
+	if r.StartLocation == nil || r.EndLocation == nil {
+		_, err := tx.Exec("DELETE FROM ride_location WHERE ride_id = ?", id)
+		return err
+	}
+
+	_, err := tx.Exec("INSERT INTO ride_location (ride_id, start_point, end_point) VALUES (?, ST_GeomFromText(?, 4326, 'axis-order=lat-long'), ST_GeomFromText(?, 4326, 'axis-order=lat-long')) "+
+		"ON DUPLICATE KEY UPDATE start_point = VALUES(start_point), end_point = VALUES(end_point)",
+		id, pointWKT(*r.StartLocation), pointWKT(*r.EndLocation))
 	return err
 }
 
-func GetRidesByUserID(db *sql.DB, userID int) ([]core.Ride, error) {
-	rows, err := db.Query("SELECT * FROM ride WHERE owner_user_id = ?", userID)
+// rideStatusColumns holds the time each status was entered.
+var rideStatusColumns = map[string]string{
+	core.RideBoarding:   "boarding_at",
+	core.RideInProgress: "started_at",
+	core.RideCompleted:  "completed_at",
+	core.RideCancelled:  "cancelled_at",
+}
+
+// TransitionRide changes the status of a ride and records when it did. The
+// ride must still be in the from status, so of two concurrent transitions
+// only one succeeds and the other gets ErrStatusChanged.
+func TransitionRide(db *sql.DB, id int, from, to string) error {
+	column, ok := rideStatusColumns[to]
+	if !ok {
+		return fmt.Errorf("no transition to status %q", to)
+	}
+
+	result, err := db.Exec(fmt.Sprintf("UPDATE ride SET status = ?, %s = NOW() WHERE id = ? AND status = ?", column), to, id, from)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	var rides []core.Ride
-	for rows.Next() {
-		var r core.Ride
-		if err := rows.Scan(&r.ID, &r.OwnerID, &r.VehicleID, &r.StartDate, &r.StartCity, &r.StartAddress, &r.EndCity, &r.EndAddress, &r.CreatedAt); err != nil {
-			return nil, err
+	if err := requireAffected(result); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrStatusChanged
 		}
-		rides = append(rides, r)
+		return err
 	}
 
-	return rides, nil
+	return nil
+}
+
+// DeleteRide deletes the ride if check accepts it and its passengers as they
+// are with the ride locked.
+func DeleteRide(db *sql.DB, id int, check func(ride *core.Ride, passengers []core.Passenger) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ride, err := lockRide(tx, id)
+	if err != nil {
+		return err
+	}
+
+	passengers, err := getPassengers(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := check(ride, passengers); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM ride WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func GetRidesByUserID(db *sql.DB, userID int, p core.PageRequest) (*core.Page[core.Ride], error) {
+	return rideList(rideSelect("NULL"), []string{"ride.owner_user_id = ?"}, []any{userID}).page(db, p)
+}
+
+func rideList(selectFrom string, conditions []string, args []any) listQuery[core.Ride] {
+	id := sortField[core.Ride]{"ride.id", func(r core.Ride) any { return r.ID }}
+	return listQuery[core.Ride]{
+		selectFrom: selectFrom,
+		conditions: conditions,
+		args:       args,
+		id:         id,
+		sorts: map[string]sortField[core.Ride]{
+			"id":         id,
+			"start_date": {"ride.start_date", func(r core.Ride) any { return r.StartDate }},
+			"start_city": {"ride.start_city", func(r core.Ride) any { return r.StartCity }},
+			"end_city":   {"ride.end_city", func(r core.Ride) any { return r.EndCity }},
+			"created_at": {"ride.created_at", func(r core.Ride) any { return r.CreatedAt }},
+		},
+		defaultSort: "start_date",
+		scan: func(rows *sql.Rows) (core.Ride, error) {
+			return scanRide(rows)
+		},
+	}
 }
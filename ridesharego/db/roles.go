@@ -0,0 +1,48 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// GetUserRoles returns the base role of the user together with every role
+// granted to them.
+func GetUserRoles(db *sql.DB, userID int) ([]string, error) {
+	rows, err := db.Query("SELECT role FROM user WHERE id = ? UNION SELECT role FROM user_role WHERE user_id = ?", userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(roles) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return roles, nil
+}
+
+func GrantUserRole(db *sql.DB, userID int, role string) error {
+	_, err := db.Exec("INSERT IGNORE INTO user_role (user_id, role) VALUES (?, ?)", userID, role)
+	return err
+}
+
+func RevokeUserRole(db *sql.DB, userID int, role string) error {
+	result, err := db.Exec("DELETE FROM user_role WHERE user_id = ? AND role = ?", userID, role)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(result)
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"main/core"
+)
+
+func GetSessionByID(db *sql.DB, id string) (*core.Session, error) {
+	row := db.QueryRow("SELECT * FROM user_session WHERE id = ?", id)
+	var s core.Session
+	if err := row.Scan(&s.ID, &s.UserID, &s.RefreshTokenHash, &s.ExpiresAt, &s.RevokedAt, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func GetSessionByRefreshTokenHash(db *sql.DB, hash string) (*core.Session, error) {
+	row := db.QueryRow("SELECT * FROM user_session WHERE refresh_token_hash = ?", hash)
+	var s core.Session
+	if err := row.Scan(&s.ID, &s.UserID, &s.RefreshTokenHash, &s.ExpiresAt, &s.RevokedAt, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func CreateSession(db *sql.DB, s core.Session) error {
+	_, err := db.Exec("INSERT INTO user_session (id, user_id, refresh_token_hash, expires_at) VALUES (?, ?, ?, ?)",
+		s.ID, s.UserID, s.RefreshTokenHash, s.ExpiresAt)
+	return err
+}
+
+// RotateSessionRefreshToken swaps the refresh token of an active session. It
+// returns sql.ErrNoRows if the old token was already used or revoked, so a
+// refresh token can only be exchanged once.
+func RotateSessionRefreshToken(db *sql.DB, id, oldHash, newHash, expiresAt string) error {
+	result, err := db.Exec("UPDATE user_session SET refresh_token_hash = ?, expires_at = ? WHERE id = ? AND refresh_token_hash = ? AND revoked_at IS NULL",
+		newHash, expiresAt, id, oldHash)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(result)
+}
+
+func RevokeSession(db *sql.DB, id string) error {
+	_, err := db.Exec("UPDATE user_session SET revoked_at = UTC_TIMESTAMP() WHERE id = ? AND revoked_at IS NULL", id)
+	return err
+}
+
+func RevokeSessionsByUserID(db *sql.DB, userID int) error {
+	_, err := db.Exec("UPDATE user_session SET revoked_at = UTC_TIMESTAMP() WHERE user_id = ? AND revoked_at IS NULL", userID)
+	return err
+}
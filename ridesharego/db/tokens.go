@@ -0,0 +1,17 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UseToken marks a single-use token as used. Using it again fails with a
+// duplicate entry error until it has expired and is cleaned up.
+func UseToken(db *sql.DB, jti string, expiresAt time.Time) error {
+	if _, err := db.Exec("DELETE FROM used_token WHERE expires_at < UTC_TIMESTAMP()"); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("INSERT INTO used_token (jti, expires_at) VALUES (?, ?)", jti, expiresAt.UTC().Format(time.DateTime))
+	return err
+}
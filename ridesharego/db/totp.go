@@ -0,0 +1,93 @@
+package db
+
+import (
+	"database/sql"
+	"main/core"
+)
+
+func GetUserTOTP(db *sql.DB, userID int) (*core.TOTP, error) {
+	row := db.QueryRow("SELECT * FROM user_totp WHERE user_id = ?", userID)
+	var t core.TOTP
+	if err := row.Scan(&t.UserID, &t.Secret, &t.ConfirmedAt, &t.LastUsedStep, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SaveUserTOTP starts a new enrolment, replacing any unconfirmed secret.
+func SaveUserTOTP(db *sql.DB, userID int, secret string) error {
+	_, err := db.Exec("INSERT INTO user_totp (user_id, secret) VALUES (?, ?) ON DUPLICATE KEY UPDATE secret = VALUES(secret), confirmed_at = NULL, last_used_step = 0, created_at = UTC_TIMESTAMP()",
+		userID, secret)
+	return err
+}
+
+func ConfirmUserTOTP(db *sql.DB, userID int, step int64) error {
+	result, err := db.Exec("UPDATE user_totp SET confirmed_at = UTC_TIMESTAMP(), last_used_step = ? WHERE user_id = ? AND confirmed_at IS NULL",
+		step, userID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// UseTOTPStep records the time step of an accepted code. It returns
+// sql.ErrNoRows if the step, or a later one, was already used, so every
+// code is accepted only once.
+func UseTOTPStep(db *sql.DB, userID int, step int64) error {
+	result, err := db.Exec("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?",
+		step, userID, step)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func DeleteUserTOTP(db *sql.DB, userID int) error {
+	if _, err := db.Exec("DELETE FROM user_recovery_code WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+	return err
+}
+
+// ReplaceRecoveryCodes invalidates the previous recovery codes of the user.
+func ReplaceRecoveryCodes(db *sql.DB, userID int, hashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_recovery_code WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if _, err := tx.Exec("INSERT INTO user_recovery_code (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks the code as used. It returns sql.ErrNoRows if the
+// code doesn't exist or was used before.
+func UseRecoveryCode(db *sql.DB, userID int, hash string) error {
+	result, err := db.Exec("UPDATE user_recovery_code SET used_at = UTC_TIMESTAMP() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hash)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+func CountRecoveryCodes(db *sql.DB, userID int) (int, error) {
+	row := db.QueryRow("SELECT COUNT(*) FROM user_recovery_code WHERE user_id = ? AND used_at IS NULL", userID)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -5,43 +5,69 @@ import (
 	"main/core"
 )
 
-func GetUsers(db *sql.DB) ([]core.User, error) {
-	rows, err := db.Query("SELECT * FROM user")
+func GetUsers(db *sql.DB, p core.PageRequest) (*core.Page[core.User], error) {
+	id := sortField[core.User]{"id", func(u core.User) any { return u.ID }}
+	return listQuery[core.User]{
+		selectFrom: "SELECT * FROM user",
+		id:         id,
+		sorts: map[string]sortField[core.User]{
+			"id":         id,
+			"name":       {"name", func(u core.User) any { return u.Name }},
+			"email":      {"email", func(u core.User) any { return u.Email }},
+			"created_at": {"created_at", func(u core.User) any { return u.CreatedAt }},
+		},
+		defaultSort: "id",
+		scan: func(rows *sql.Rows) (core.User, error) {
+			var u core.User
+			err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Settings, &u.EmailVerifiedAt, &u.CreatedAt)
+			return u, err
+		},
+	}.page(db, p)
+}
+
+func GetUserByID(db *sql.DB, id int64) (*core.User, error) {
+	row := db.QueryRow("SELECT * FROM user WHERE id = ?", id)
+	var u core.User
+	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Settings, &u.EmailVerifiedAt, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var users []core.User
-	for rows.Next() {
-		var u core.User
-		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Settings, &u.CreatedAt); err != nil {
-			return nil, err
-		}
-		users = append(users, u)
-	}
-
-	return users, nil
+	return &u, nil
 }
 
-func GetUserByID(db *sql.DB, id int64) (*core.User, error) {
-	row := db.QueryRow("SELECT * FROM user WHERE id = ?", id)
+func GetUserByEmail(db *sql.DB, email string) (*core.User, error) {
+	row := db.QueryRow("SELECT * FROM user WHERE email = ?", email)
 	var u core.User
-	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Settings, &u.CreatedAt)
+	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.Settings, &u.EmailVerifiedAt, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return &u, nil
 }
 
+// GetUserRating averages the feedback left on rides the user drove.
+func GetUserRating(db *sql.DB, userID int) (*core.UserRating, error) {
+	row := db.QueryRow("SELECT COALESCE(AVG(uf.score), 0), COUNT(uf.id) FROM user_feedback uf JOIN ride r ON r.id = uf.ride_id WHERE r.owner_user_id = ?", userID)
+	var rating core.UserRating
+	if err := row.Scan(&rating.Average, &rating.Count); err != nil {
+		return nil, err
+	}
+	return &rating, nil
+}
+
 func CreateUser(db *sql.DB, u core.User) (int64, error) {
 	settings := u.Settings
 	if len(settings) == 0 {
 		settings = []byte("{}")
 	}
 
-	result, err := db.Exec("INSERT INTO user (name, email, password, settings) VALUES (?, ?, ?, ?)",
-		u.Name, u.Email, u.Password, settings)
+	role := u.Role
+	if role == "" {
+		role = core.RoleUser
+	}
+
+	result, err := db.Exec("INSERT INTO user (name, email, password, role, settings, email_verified_at) VALUES (?, ?, ?, ?, ?, ?)",
+		u.Name, u.Email, u.Password, role, settings, u.EmailVerifiedAt)
 	if err != nil {
 		return 0, err
 	}
@@ -54,9 +80,24 @@ func CreateUser(db *sql.DB, u core.User) (int64, error) {
 	return id, nil
 }
 
+// UpdateUser keeps the email verified only if it didn't change, and the
+// stored password if u has none. MySQL applies the assignments in order, so
+// the email check has to come before the new email.
 func UpdateUser(db *sql.DB, id int64, u core.User) error {
-	_, err := db.Exec("UPDATE user SET name = ?, email = ?, password = ?, role = ?, settings = ? WHERE id = ?",
-		u.Name, u.Email, u.Password, u.Role, u.Settings, id)
+	_, err := db.Exec("UPDATE user SET email_verified_at = IF(email = ?, email_verified_at, NULL), name = ?, email = ?, password = COALESCE(NULLIF(?, ''), password), role = ?, settings = ? WHERE id = ?",
+		u.Email, u.Name, u.Email, u.Password, u.Role, u.Settings, id)
+	return err
+}
+
+func UpdateUserPassword(db *sql.DB, id int64, password string) error {
+	_, err := db.Exec("UPDATE user SET password = ? WHERE id = ?", password, id)
+	return err
+}
+
+// MarkEmailVerified only verifies the email the user still has, in case it
+// changed after the verification was sent.
+func MarkEmailVerified(db *sql.DB, id int, email string) error {
+	_, err := db.Exec("UPDATE user SET email_verified_at = UTC_TIMESTAMP() WHERE id = ? AND email = ? AND email_verified_at IS NULL", id, email)
 	return err
 }
 
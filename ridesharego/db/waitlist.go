@@ -0,0 +1,150 @@
+package db
+
+import (
+	"database/sql"
+	"main/core"
+)
+
+// waitlistSelect reads entries with their position in the line of the ride.
+const waitlistSelect = "SELECT w.*, (SELECT COUNT(*) FROM ride_waitlist f WHERE f.ride_id = w.ride_id AND f.id <= w.id) FROM ride_waitlist w"
+
+func scanWaitlistEntry(row scanner) (*core.WaitlistEntry, error) {
+	var e core.WaitlistEntry
+	if err := row.Scan(&e.ID, &e.RideID, &e.UserID, &e.Seats, &e.CreatedAt, &e.Position); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func GetWaitlistEntry(db *sql.DB, rideID, userID int) (*core.WaitlistEntry, error) {
+	return scanWaitlistEntry(db.QueryRow(waitlistSelect+" WHERE w.ride_id = ? AND w.user_id = ?", rideID, userID))
+}
+
+// JoinWaitlist puts the rider at the end of the line if check accepts the
+// ride and its passengers. Like BookSeat it locks the ride, so riders can't
+// join while seats are being freed.
+func JoinWaitlist(db *sql.DB, e core.WaitlistEntry, check func(ride *core.Ride, passengers []core.Passenger) error) (*core.WaitlistEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ride, err := lockRide(tx, e.RideID)
+	if err != nil {
+		return nil, err
+	}
+
+	passengers, err := getPassengers(tx, e.RideID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := check(ride, passengers); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("INSERT INTO ride_waitlist (ride_id, user_id, seats) VALUES (?, ?, ?)", e.RideID, e.UserID, e.Seats); err != nil {
+		return nil, err
+	}
+
+	entry, err := scanWaitlistEntry(tx.QueryRow(waitlistSelect+" WHERE w.ride_id = ? AND w.user_id = ?", e.RideID, e.UserID))
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, tx.Commit()
+}
+
+func LeaveWaitlist(db *sql.DB, rideID, userID int) error {
+	result, err := db.Exec("DELETE FROM ride_waitlist WHERE ride_id = ? AND user_id = ?", rideID, userID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// lockRide locks the ride row until the transaction ends and reads the ride.
+// Everything that takes or frees seats locks the ride first.
+func lockRide(tx *sql.Tx, rideID int) (*core.Ride, error) {
+	var id int
+	if err := tx.QueryRow("SELECT id FROM ride WHERE id = ? FOR UPDATE", rideID).Scan(&id); err != nil {
+		return nil, err
+	}
+
+	ride, err := scanRide(tx.QueryRow(rideSelect("NULL")+" WHERE ride.id = ?", rideID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ride, nil
+}
+
+// promoteWaitlist books the free seats of a scheduled ride for the riders on
+// its waitlist, in the order they joined. It stops at the first rider who
+// needs more seats than are free, so nobody is skipped. The ride must be
+// locked by the transaction.
+func promoteWaitlist(tx *sql.Tx, rideID int) ([]core.Passenger, error) {
+	ride, err := scanRide(tx.QueryRow(rideSelect("NULL")+" WHERE ride.id = ?", rideID))
+	if err != nil {
+		return nil, err
+	}
+
+	if ride.Status != core.RideScheduled {
+		return nil, nil
+	}
+
+	var promoted []core.Passenger
+	free := ride.SeatsFree
+	for {
+		entry, err := scanWaitlistEntry(tx.QueryRow(waitlistSelect+" WHERE w.ride_id = ? ORDER BY w.id LIMIT 1", rideID))
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// riders who booked or were turned down since joining keep their
+		// booking, it isn't overwritten or counted twice. Expired requests
+		// are replaced like when booking again.
+		var booked bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM ride_passenger WHERE ride_id = ? AND passenger_id = ? AND status <> 'expired')", rideID, entry.UserID).Scan(&booked); err != nil {
+			return nil, err
+		}
+
+		if booked {
+			if _, err := tx.Exec("DELETE FROM ride_waitlist WHERE id = ?", entry.ID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if entry.Seats > free {
+			break
+		}
+
+		rp := core.Passenger{
+			RideID:      rideID,
+			PassengerID: entry.UserID,
+			Seats:       entry.Seats,
+			Status:      core.PassengerAccepted,
+		}
+		if ride.ManualApproval {
+			rp.Status = core.PassengerPending
+		}
+
+		if err := insertBooking(tx, rp); err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec("DELETE FROM ride_waitlist WHERE id = ?", entry.ID); err != nil {
+			return nil, err
+		}
+
+		free -= entry.Seats
+		promoted = append(promoted, rp)
+	}
+
+	return promoted, nil
+}
@@ -0,0 +1,232 @@
+package geo
+
+import (
+	"bufio"
+	"fmt"
+	"main/core"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// columns of the GeoNames dumps, see
+// https://download.geonames.org/export/dump/readme.txt
+const (
+	columnID             = 0
+	columnName           = 1
+	columnASCIIName      = 2
+	columnAlternateNames = 3
+	columnLatitude       = 4
+	columnLongitude      = 5
+	columnCountry        = 8
+	columnPopulation     = 14
+	columnCount          = 15
+
+	maxLineSize = 1 << 20
+)
+
+type placeName struct {
+	key   string
+	place int
+}
+
+// Gazetteer geocodes city names offline from a GeoNames dump such as
+// cities15000.txt. Names are matched case-insensitively, by their ASCII
+// spelling and by their alternate names. Ambiguous names resolve to the most
+// populated place.
+type Gazetteer struct {
+	places []core.Place
+	// names is sorted by key so exact and prefix matches are binary searches
+	names []placeName
+}
+
+// LoadGazetteer reads the GeoNames dump at path. Without a path the
+// gazetteer is empty, names are then only cleaned up and never geocoded.
+func LoadGazetteer(path string) (*Gazetteer, error) {
+	g := &Gazetteer{}
+	if path == "" {
+		return g, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		place, names, err := parsePlace(strings.Split(text, "\t"))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		g.add(place, names)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	sort.Slice(g.names, func(i, j int) bool {
+		return g.names[i].key < g.names[j].key
+	})
+
+	return g, nil
+}
+
+func parsePlace(fields []string) (core.Place, []string, error) {
+	var place core.Place
+	if len(fields) < columnCount {
+		return place, nil, fmt.Errorf("expected %d columns, got %d", columnCount, len(fields))
+	}
+
+	var err error
+	if place.ID, err = strconv.Atoi(fields[columnID]); err != nil {
+		return place, nil, fmt.Errorf("invalid id %q", fields[columnID])
+	}
+
+	if place.Location.Lat, err = strconv.ParseFloat(fields[columnLatitude], 64); err != nil {
+		return place, nil, fmt.Errorf("invalid latitude %q", fields[columnLatitude])
+	}
+
+	if place.Location.Lng, err = strconv.ParseFloat(fields[columnLongitude], 64); err != nil {
+		return place, nil, fmt.Errorf("invalid longitude %q", fields[columnLongitude])
+	}
+
+	if err := place.Location.Validate(); err != nil {
+		return place, nil, err
+	}
+
+	if population := fields[columnPopulation]; population != "" {
+		if place.Population, err = strconv.Atoi(population); err != nil {
+			return place, nil, fmt.Errorf("invalid population %q", population)
+		}
+	}
+
+	place.Name = CleanName(fields[columnName])
+	if place.Name == "" {
+		return place, nil, fmt.Errorf("missing name")
+	}
+	place.Country = fields[columnCountry]
+
+	names := []string{place.Name, fields[columnASCIIName]}
+	if alternates := fields[columnAlternateNames]; alternates != "" {
+		names = append(names, strings.Split(alternates, ",")...)
+	}
+
+	return place, names, nil
+}
+
+func (g *Gazetteer) add(place core.Place, names []string) {
+	index := len(g.places)
+	g.places = append(g.places, place)
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		key := nameKey(name)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		g.names = append(g.names, placeName{key: key, place: index})
+	}
+}
+
+// Len returns the number of places.
+func (g *Gazetteer) Len() int {
+	return len(g.places)
+}
+
+// Lookup returns the most populated place called name, or nil if there is
+// none.
+func (g *Gazetteer) Lookup(name string) *core.Place {
+	key := nameKey(name)
+	if key == "" {
+		return nil
+	}
+
+	var best *core.Place
+	for i := g.search(key); i < len(g.names) && g.names[i].key == key; i++ {
+		place := &g.places[g.names[i].place]
+		if best == nil || place.Population > best.Population {
+			best = place
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	place := *best
+	return &place
+}
+
+// Normalize returns the gazetteer name of a city together with the place.
+// Cities that aren't found keep their name with the whitespace cleaned up.
+func (g *Gazetteer) Normalize(city string) (string, *core.Place) {
+	if place := g.Lookup(city); place != nil {
+		return place.Name, place
+	}
+	return CleanName(city), nil
+}
+
+// Suggest returns up to limit places with a name starting with prefix, the
+// most populated first.
+func (g *Gazetteer) Suggest(prefix string, limit int) []core.Place {
+	places := []core.Place{}
+
+	key := nameKey(prefix)
+	if key == "" || limit <= 0 {
+		return places
+	}
+
+	seen := map[int]bool{}
+	var matches []int
+	for i := g.search(key); i < len(g.names) && strings.HasPrefix(g.names[i].key, key); i++ {
+		if index := g.names[i].place; !seen[index] {
+			seen[index] = true
+			matches = append(matches, index)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := g.places[matches[i]], g.places[matches[j]]
+		if a.Population != b.Population {
+			return a.Population > b.Population
+		}
+		return a.ID < b.ID
+	})
+
+	for _, index := range matches {
+		if len(places) == limit {
+			break
+		}
+		places = append(places, g.places[index])
+	}
+
+	return places
+}
+
+// search returns the index of the first name with a key not before key.
+func (g *Gazetteer) search(key string) int {
+	return sort.Search(len(g.names), func(i int) bool {
+		return g.names[i].key >= key
+	})
+}
+
+// CleanName trims a name and collapses its inner whitespace, so "Kaunas"
+// and " Kaunas " are stored the same way.
+func CleanName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func nameKey(name string) string {
+	return strings.ToLower(CleanName(name))
+}
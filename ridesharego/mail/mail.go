@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"main/core"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	driverSMTP = "smtp"
+	driverFile = "file"
+	driverLog  = "log"
+
+	defaultSMTPPort = "587"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// NewMailer returns the mailer selected in the config, SMTP if none is.
+func NewMailer(config core.MailConfig, log *logrus.Entry) (Mailer, error) {
+	if config.From == "" && config.Driver != driverLog {
+		return nil, errors.New("mail: missing from address")
+	}
+
+	switch config.Driver {
+	case "", driverSMTP:
+		if config.SMTP.Host == "" {
+			return nil, errors.New(`mail: missing smtp host, use the "log" or "file" driver for local development`)
+		}
+
+		port := config.SMTP.Port
+		if port == "" {
+			port = defaultSMTPPort
+		}
+
+		return &smtpMailer{
+			from:     config.From,
+			address:  net.JoinHostPort(config.SMTP.Host, port),
+			host:     config.SMTP.Host,
+			username: config.SMTP.Username,
+			password: config.SMTP.Password,
+		}, nil
+	case driverFile:
+		if config.Path == "" {
+			return nil, errors.New("mail: missing path for the file driver")
+		}
+		return &fileMailer{from: config.From, path: config.Path}, nil
+	case driverLog:
+		return &logMailer{log: log}, nil
+	default:
+		return nil, fmt.Errorf("mail: unknown driver %q", config.Driver)
+	}
+}
+
+// format renders the message as a plain text email.
+func format(from string, msg Message, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validate keeps header injection out of the recipient and subject.
+func validate(msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return errors.New("mail: invalid header value")
+	}
+	return nil
+}
+
+type smtpMailer struct {
+	from     string
+	address  string
+	host     string
+	username string
+	password string
+}
+
+// Send uses STARTTLS whenever the server offers it.
+func (m *smtpMailer) Send(msg Message) error {
+	if err := validate(msg); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	return smtp.SendMail(m.address, auth, m.from, []string{msg.To}, format(m.from, msg, time.Now()))
+}
+
+// fileMailer appends every message to a file instead of sending it.
+type fileMailer struct {
+	mu   sync.Mutex
+	from string
+	path string
+}
+
+func (m *fileMailer) Send(msg Message) error {
+	if err := validate(msg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(format(m.from, msg, time.Now())); err != nil {
+		return err
+	}
+
+	_, err = file.WriteString("\r\n\r\n")
+	return err
+}
+
+// logMailer only logs messages, links in them can be copied from the output.
+type logMailer struct {
+	log *logrus.Entry
+}
+
+func (m *logMailer) Send(msg Message) error {
+	if err := validate(msg); err != nil {
+		return err
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"to":      msg.To,
+		"subject": msg.Subject,
+	}).Info(msg.Body)
+	return nil
+}
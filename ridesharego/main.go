@@ -5,13 +5,17 @@ import (
 	"main/auth"
 	"main/core"
 	"main/db"
+	"main/geo"
+	"main/mail"
 	"net/http"
 )
 
+const configPath = "./config.json"
+
 func main() {
 	log := core.SetupLogging()
 
-	config, err := core.LoadConfig("./config.json")
+	config, err := core.LoadConfig(configPath)
 	if err != nil {
 		log.WithError(err).Fatal("can't load config")
 	}
@@ -22,10 +26,67 @@ func main() {
 	}
 	defer db.Close()
 
-	r := api.CreateRouter(db, config.Server.AuthSecret)
+	limiter, err := auth.NewLimiter(config.BruteForce, db)
+	if err != nil {
+		log.WithError(err).Fatal("can't initialize brute force protection")
+	}
+
+	keys, err := auth.NewKeyring(config.Signing.Keys, log)
+	if err != nil {
+		log.WithError(err).Fatal("can't load signing keys")
+	}
+	keys.Watch(config.Signing.ReloadInterval.Duration, func() ([]core.SigningKeyConfig, error) {
+		config, err := core.LoadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		return config.Signing.Keys, nil
+	})
+
+	gazetteer, err := geo.LoadGazetteer(config.Geocoding.Gazetteer)
+	if err != nil {
+		log.WithError(err).Fatal("can't load gazetteer")
+	}
+	if gazetteer.Len() == 0 {
+		log.Warn("no gazetteer configured, rides won't be geocoded")
+	} else {
+		log.WithField("places", gazetteer.Len()).Info("gazetteer loaded")
+	}
+
+	mailer, err := mail.NewMailer(config.Mail, log)
+	if err != nil {
+		log.WithError(err).Fatal("can't initialize mailer")
+	}
+
+	providers := config.OAuthProviders
+	if config.GoogleAuth.ClientID != "" {
+		providers = append(providers, auth.GoogleProvider(config.GoogleAuth))
+	}
+
+	twoFactorModule, err := auth.NewTwoFactorModule(config.TwoFactor, db, keys, limiter)
+	if err != nil {
+		log.WithError(err).Fatal("can't initialize 2FA")
+	}
+
+	oauthModule, err := auth.NewOAuthModule(providers, db, keys, config.Server.FrontendURL, twoFactorModule)
+	if err != nil {
+		log.WithError(err).Fatal("can't initialize OAuth2 providers")
+	}
+
+	r := api.CreateRouter(db, keys, limiter, gazetteer, mailer, oauthModule)
+	api.ExpireBookings(db, config.Booking, mailer, log)
+	keys.ApplyRoutes(r)
+	twoFactorModule.ApplyRoutes(r)
+	oauthModule.ApplyRoutes(r)
+
+	emailModule := auth.NewEmailModule(db, keys, mailer, config.Server.VerifyEmailURL, config.Server.ResetPasswordURL, limiter)
+	emailModule.ApplyRoutes(r)
+
+	passwordAuthModule := auth.NewPasswordAuthModule(db, keys, twoFactorModule, emailModule, limiter)
+	passwordAuthModule.ApplyRoutes(r)
 
-	googleAuthModule := auth.NewGoogleAuthModule(config.GoogleAuth, db, config.Server.AuthSecret)
-	googleAuthModule.ApplyRoutes(r)
+	sessionModule := auth.NewSessionModule(db, keys, limiter)
+	sessionModule.ApplyRoutes(r)
 
 	port := config.Server.Port
 	log.WithField("port", port).Info("starting server")